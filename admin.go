@@ -0,0 +1,208 @@
+package main
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/packing/clove/utils"
+)
+
+type AdminRequest struct {
+    Command string      `json:"command"`
+    Args    interface{} `json:"args"`
+}
+
+type AdminResponse struct {
+    Ok     bool        `json:"ok"`
+    Result interface{} `json:"result,omitempty"`
+    Error  string      `json:"error,omitempty"`
+}
+
+type AdminCommandFunc func(args interface{}) (interface{}, error)
+
+var (
+    adminAddr  = ""
+    adminToken = ""
+    adminAudit = ""
+
+    adminListener net.Listener
+    adminServer   *http.Server
+
+    //管理指令借用脚本上下文的最长等待时间, 避免VM池耗尽时请求一直挂起
+    adminVMWait = 5 * time.Second
+
+    adminAuditLock sync.Mutex
+    adminAuditFile *os.File
+
+    //由Go侧直接处理的内置指令, 未命中时转交脚本的__admin__
+    adminCommands = make(map[string]AdminCommandFunc)
+)
+
+func registerAdminCommand(name string, fn AdminCommandFunc) {
+    adminCommands[name] = fn
+}
+
+func writeAdminAudit(remote string, req *AdminRequest, rsp *AdminResponse, cost time.Duration) {
+    args, _ := json.Marshal(req.Args)
+    line := fmt.Sprintf("%s remote=%s command=%q args=%s ok=%v error=%q cost=%s\n",
+        time.Now().Format(time.RFC3339), remote, req.Command, string(args), rsp.Ok, rsp.Error, cost)
+
+    adminAuditLock.Lock()
+    defer adminAuditLock.Unlock()
+    if adminAuditFile != nil {
+        adminAuditFile.WriteString(line)
+    } else {
+        utils.LogInfo("[ADMIN] %s", strings.TrimRight(line, "\n"))
+    }
+}
+
+func execAdminCommand(req *AdminRequest) *AdminResponse {
+    if fn, ok := adminCommands[req.Command]; ok {
+        r, err := fn(req.Args)
+        if err != nil {
+            return &AdminResponse{Error: err.Error()}
+        }
+        return &AdminResponse{Ok: true, Result: r}
+    }
+
+    vm := borrowGojaVMTimeout(adminVMWait)
+    if vm == nil {
+        return &AdminResponse{Error: "script engine is busy or not available"}
+    }
+    defer returnGojaVM(vm)
+
+    r, err := vm.DispatchAdmin(req.Command, req.Args)
+    if err != nil {
+        return &AdminResponse{Error: err.Error()}
+    }
+    return &AdminResponse{Ok: true, Result: r}
+}
+
+func checkAdminToken(r *http.Request) bool {
+    if adminToken == "" {
+        return false
+    }
+    token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+func onAdminRequest(w http.ResponseWriter, r *http.Request) {
+    defer func() {
+        utils.LogPanic(recover())
+    }()
+
+    w.Header().Set("Content-Type", "application/json")
+
+    if r.Method != http.MethodPost {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    remote := r.RemoteAddr
+    if remote == "" || remote == "@" {
+        remote = "unix"
+    }
+
+    req := new(AdminRequest)
+    if !checkAdminToken(r) {
+        rsp := &AdminResponse{Error: "unauthorized"}
+        writeAdminAudit(remote, req, rsp, 0)
+        w.WriteHeader(http.StatusUnauthorized)
+        json.NewEncoder(w).Encode(rsp)
+        return
+    }
+
+    body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1048576))
+    if err == nil {
+        err = json.Unmarshal(body, req)
+    }
+    if err != nil || req.Command == "" {
+        rsp := &AdminResponse{Error: "bad request"}
+        writeAdminAudit(remote, req, rsp, 0)
+        w.WriteHeader(http.StatusBadRequest)
+        json.NewEncoder(w).Encode(rsp)
+        return
+    }
+
+    tb := time.Now()
+    rsp := execAdminCommand(req)
+    writeAdminAudit(remote, req, rsp, time.Since(tb))
+
+    if !rsp.Ok {
+        w.WriteHeader(http.StatusInternalServerError)
+    }
+    if err := json.NewEncoder(w).Encode(rsp); err != nil {
+        utils.LogError("!!!管理接口返回结果无法序列化 %s", err.Error())
+    }
+}
+
+//addr以/开头时使用unix socket, 否则仅允许监听本机地址; 两种方式都必须配置token
+func startAdmin() error {
+    if adminAddr == "" {
+        return nil
+    }
+    if adminToken == "" {
+        return fmt.Errorf("admin addr %s requires a token", adminAddr)
+    }
+
+    if adminAudit != "" {
+        f, err := os.OpenFile(adminAudit, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+        if err != nil {
+            return err
+        }
+        adminAuditFile = f
+    }
+
+    var err error
+    if strings.HasPrefix(adminAddr, "/") {
+        os.Remove(adminAddr)
+        //先收紧umask再创建socket文件, 避免chmod之前存在可被其他用户连接的窗口
+        mask := syscall.Umask(0177)
+        adminListener, err = net.Listen("unix", adminAddr)
+        syscall.Umask(mask)
+    } else {
+        host, _, e := net.SplitHostPort(adminAddr)
+        if e != nil {
+            return e
+        }
+        ip := net.ParseIP(host)
+        if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+            return fmt.Errorf("admin addr %s is not a localhost address", adminAddr)
+        }
+        adminListener, err = net.Listen("tcp", adminAddr)
+    }
+    if err != nil {
+        return err
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/admin", onAdminRequest)
+    adminServer = &http.Server{Handler: mux}
+    go adminServer.Serve(adminListener)
+
+    utils.LogInfo(">>> 管理接口已监听 %s", adminAddr)
+    return nil
+}
+
+func stopAdmin() {
+    if adminServer != nil {
+        adminServer.Close()
+        adminServer = nil
+    }
+    if strings.HasPrefix(adminAddr, "/") {
+        os.Remove(adminAddr)
+    }
+    if adminAuditFile != nil {
+        adminAuditFile.Close()
+        adminAuditFile = nil
+    }
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/packing/goja"
+)
+
+func TestDispatchAdminNonASCII(t *testing.T) {
+    vm := &GojaVM{Runtime: goja.New()}
+    if _, err := vm.Runtime.RunString(`function __admin__(cmd, args) { return {cmd: cmd, status: "维护中", args: args} }`); err != nil {
+        t.Fatal(err)
+    }
+    r, err := vm.DispatchAdmin("状态", map[string]interface{}{"note": "服务器"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := `{"args":{"note":"服务器"},"cmd":"状态","status":"维护中"}`
+    if string(r) != want {
+        t.Errorf("got %s, want %s", r, want)
+    }
+}
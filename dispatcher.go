@@ -42,8 +42,11 @@ func OnDeliver(msg *messages.Message) error {
                 r := codecs.CreateMapReader(body)
                 addr = r.StrValueOf(messages.ProtocolKeyHost, addr)
             }
-            //初始化默认全局锁键
-            globalStorage.InitLock(realMsg.GetSessionId()[0])
+            if vm.GetAssociatedSourceId() > 0 {
+                enterSession(realMsg.GetSessionId()[0], addr, vm.GetAssociatedSourceId(), "")
+            } else {
+                enterSession(realMsg.GetSessionId()[0], addr, 0, msg.GetUnixSource())
+            }
             vm.DispatchEnter(realMsg.GetSessionId()[0], addr)
         } else if realMsg.GetType() == messages.ProtocolTypeClientLeave {
             addr := ""
@@ -52,11 +55,15 @@ func OnDeliver(msg *messages.Message) error {
                 r := codecs.CreateMapReader(body)
                 addr = r.StrValueOf(messages.ProtocolKeyHost, addr)
             }
-            //销毁全局锁键
-            globalStorage.DisposeLock(realMsg.GetSessionId()[0])
             vm.DispatchLeave(realMsg.GetSessionId()[0], addr)
+            leaveAllRooms(realMsg.GetSessionId()[0])
+            leaveSession(realMsg.GetSessionId()[0])
         } else {
-            vm.DispatchMessage(realMsg.GetSessionId()[0], data)
+            touchSession(realMsg.GetSessionId()[0])
+            gvm, ok := vm.(*GojaVM)
+            if !ok || realMsg.GetSearial() == 0 || gvm.DispatchRequest(realMsg.GetSessionId()[0], data) < 0 {
+                vm.DispatchMessage(realMsg.GetSessionId()[0], data)
+            }
         }
 
         vm.SetValue("CurrentSessionId", 0)
@@ -92,5 +99,8 @@ func OnDeliver(msg *messages.Message) error {
 func (receiver ClientMessageObject) GetMappedTypes() map[int]messages.MessageProcFunc {
     msgMap := make(map[int]messages.MessageProcFunc)
     msgMap[messages.ProtocolTypeDeliver] = OnDeliver
+    msgMap[messages.ProtocolTypeSlaveHello] = OnSlaveHello
+    msgMap[ProtocolTypeSlaveRPC] = OnRPC
+    msgMap[ProtocolTypeSlaveRPCReturn] = OnRPCReturn
     return msgMap
 }
@@ -9,6 +9,6 @@ require (
 	github.com/packing/goja v0.0.0-20200920212024-281ab7ea99b1
 	github.com/packing/goja_nodejs v0.0.0-20200920203854-500fbd9f4405
 	github.com/packing/v8go v0.0.0-20210422140534-d132cff17433
-	golang.org/x/text v0.3.5 // indirect
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
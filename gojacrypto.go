@@ -0,0 +1,247 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/md5"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/sha512"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/hex"
+    "fmt"
+    "hash"
+    "math/big"
+    "strings"
+
+    "github.com/packing/clove/utils"
+    "github.com/packing/goja"
+    "golang.org/x/crypto/bcrypt"
+)
+
+//cost每加1耗时翻倍, 设置上限避免传入的参数或构造的哈希长时间占用VM
+const (
+    passwordHashMinCost = bcrypt.DefaultCost
+    passwordHashMaxCost = 14
+)
+
+func cryptoHashFunc(alg string) func() hash.Hash {
+    switch strings.ToLower(alg) {
+    case "md5":
+        return md5.New
+    case "sha1":
+        return sha1.New
+    case "sha256":
+        return sha256.New
+    case "sha512":
+        return sha512.New
+    }
+    return nil
+}
+
+//按编码方式返回摘要, 默认返回Uint8Array
+func (n GojaVMNet) cryptoResult(bs []byte, call goja.FunctionCall, encIdx int) goja.Value {
+    enc := ""
+    if len(call.Arguments) > encIdx && !goja.IsUndefined(call.Arguments[encIdx]) && !goja.IsNull(call.Arguments[encIdx]) {
+        enc = call.Arguments[encIdx].String()
+    }
+    switch enc {
+    case "hex":
+        return n.vm.Runtime.ToValue(hex.EncodeToString(bs))
+    case "base64":
+        return n.vm.Runtime.ToValue(base64.StdEncoding.EncodeToString(bs))
+    }
+    return gojaBytesValue(n.vm, bs)
+}
+
+func (n GojaVMNet) cryptoDigest(alg string) func(goja.FunctionCall) goja.Value {
+    return func(call goja.FunctionCall) goja.Value {
+        if len(call.Arguments) == 0 {
+            return goja.Null()
+        }
+        h := cryptoHashFunc(alg)()
+        h.Write(gojaValueToBytes(call.Arguments[0]))
+        return n.cryptoResult(h.Sum(nil), call, 1)
+    }
+}
+
+func (n GojaVMNet) Hash(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) < 2 {
+        return goja.Null()
+    }
+    fn := cryptoHashFunc(call.Arguments[0].String())
+    if fn == nil {
+        stacks := make([]goja.StackFrame, 5)
+        errStr := GenGojaStackFrameString(n.vm, "[J] !!! Unsupported hash algorithm "+call.Arguments[0].String(), n.vm.Runtime.CaptureCallStack(5, stacks))
+        utils.LogError(errStr)
+        return goja.Null()
+    }
+    h := fn()
+    h.Write(gojaValueToBytes(call.Arguments[1]))
+    return n.cryptoResult(h.Sum(nil), call, 2)
+}
+
+func (n GojaVMNet) Hmac(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) < 3 {
+        return goja.Null()
+    }
+    fn := cryptoHashFunc(call.Arguments[0].String())
+    if fn == nil {
+        stacks := make([]goja.StackFrame, 5)
+        errStr := GenGojaStackFrameString(n.vm, "[J] !!! Unsupported hmac algorithm "+call.Arguments[0].String(), n.vm.Runtime.CaptureCallStack(5, stacks))
+        utils.LogError(errStr)
+        return goja.Null()
+    }
+    h := hmac.New(fn, gojaValueToBytes(call.Arguments[1]))
+    h.Write(gojaValueToBytes(call.Arguments[2]))
+    return n.cryptoResult(h.Sum(nil), call, 3)
+}
+
+func (n GojaVMNet) SafeEqual(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) < 2 {
+        return n.vm.Runtime.ToValue(false)
+    }
+    a := gojaValueToBytes(call.Arguments[0])
+    b := gojaValueToBytes(call.Arguments[1])
+    return n.vm.Runtime.ToValue(subtle.ConstantTimeCompare(a, b) == 1)
+}
+
+func (n GojaVMNet) RandomBytes(call goja.FunctionCall) goja.Value {
+    size := int64(16)
+    if len(call.Arguments) > 0 && !goja.IsUndefined(call.Arguments[0]) && !goja.IsNull(call.Arguments[0]) {
+        size = call.Arguments[0].ToInteger()
+    }
+    if size < 0 || size > 65536 {
+        return goja.Null()
+    }
+    bs := make([]byte, size)
+    if _, err := rand.Read(bs); err != nil {
+        utils.LogError("[J] !!! Random source error: %s", err.Error())
+        return goja.Null()
+    }
+    return n.cryptoResult(bs, call, 1)
+}
+
+//返回[min, max)区间内的随机整数
+func (n GojaVMNet) RandomInt(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 {
+        return goja.Null()
+    }
+    min := int64(0)
+    max := call.Arguments[0].ToInteger()
+    if len(call.Arguments) > 1 && !goja.IsUndefined(call.Arguments[1]) {
+        min = max
+        max = call.Arguments[1].ToInteger()
+    }
+    if max <= min {
+        return goja.Null()
+    }
+    r, err := rand.Int(rand.Reader, new(big.Int).Sub(big.NewInt(max), big.NewInt(min)))
+    if err != nil {
+        utils.LogError("[J] !!! Random source error: %s", err.Error())
+        return goja.Null()
+    }
+    return n.vm.Runtime.ToValue(r.Int64() + min)
+}
+
+func (n GojaVMNet) UUID(call goja.FunctionCall) goja.Value {
+    var u [16]byte
+    if _, err := rand.Read(u[:]); err != nil {
+        utils.LogError("[J] !!! Random source error: %s", err.Error())
+        return goja.Null()
+    }
+    u[6] = (u[6] & 0x0f) | 0x40
+    u[8] = (u[8] & 0x3f) | 0x80
+    s := fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+    return n.vm.Runtime.ToValue(s)
+}
+
+func (n GojaVMNet) HexEncode(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 {
+        return goja.Null()
+    }
+    return n.vm.Runtime.ToValue(hex.EncodeToString(gojaValueToBytes(call.Arguments[0])))
+}
+
+func (n GojaVMNet) HexDecode(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 {
+        return goja.Null()
+    }
+    bs, err := hex.DecodeString(call.Arguments[0].String())
+    if err != nil {
+        return goja.Null()
+    }
+    return gojaBytesValue(n.vm, bs)
+}
+
+func (n GojaVMNet) Base64Encode(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 {
+        return goja.Null()
+    }
+    enc := base64.StdEncoding
+    if len(call.Arguments) > 1 && call.Arguments[1].ToBoolean() {
+        enc = base64.RawURLEncoding
+    }
+    return n.vm.Runtime.ToValue(enc.EncodeToString(gojaValueToBytes(call.Arguments[0])))
+}
+
+func (n GojaVMNet) Base64Decode(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 {
+        return goja.Null()
+    }
+    s := call.Arguments[0].String()
+    enc := base64.StdEncoding
+    if len(call.Arguments) > 1 && call.Arguments[1].ToBoolean() {
+        enc = base64.RawURLEncoding
+    }
+    bs, err := enc.DecodeString(s)
+    if err != nil {
+        return goja.Null()
+    }
+    return gojaBytesValue(n.vm, bs)
+}
+
+func (n GojaVMNet) BytesToString(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 {
+        return goja.Null()
+    }
+    return n.vm.Runtime.ToValue(string(gojaValueToBytes(call.Arguments[0])))
+}
+
+//bcrypt格式: $2a$<cost>$<salt+hash>, 可选的第二个参数为cost
+func (n GojaVMNet) HashPassword(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 {
+        return goja.Null()
+    }
+    cost := passwordHashMinCost
+    if len(call.Arguments) > 1 && !goja.IsUndefined(call.Arguments[1]) && !goja.IsNull(call.Arguments[1]) {
+        cost = int(call.Arguments[1].ToInteger())
+    }
+    if cost < passwordHashMinCost {
+        cost = passwordHashMinCost
+    }
+    if cost > passwordHashMaxCost {
+        cost = passwordHashMaxCost
+    }
+    bs, err := bcrypt.GenerateFromPassword(gojaValueToBytes(call.Arguments[0]), cost)
+    if err != nil {
+        utils.LogError("[J] !!! Hash password error: %s", err.Error())
+        return goja.Null()
+    }
+    return n.vm.Runtime.ToValue(string(bs))
+}
+
+//cost超过上限的哈希直接视为不匹配
+func (n GojaVMNet) VerifyPassword(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) < 2 {
+        return n.vm.Runtime.ToValue(false)
+    }
+    hashed := []byte(call.Arguments[1].String())
+    cost, err := bcrypt.Cost(hashed)
+    if err != nil || cost > passwordHashMaxCost {
+        return n.vm.Runtime.ToValue(false)
+    }
+    err = bcrypt.CompareHashAndPassword(hashed, gojaValueToBytes(call.Arguments[0]))
+    return n.vm.Runtime.ToValue(err == nil)
+}
@@ -2,11 +2,16 @@ package main
 
 import (
     "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
     "io/ioutil"
     "net/url"
     "os"
     "strconv"
-    "sync/atomic"
+    "strings"
+    "sync"
+    "time"
 
     "github.com/go-sourcemap/sourcemap"
     "github.com/packing/clove/codecs"
@@ -156,7 +161,8 @@ func EnableConsole(runtime *goja.Runtime) {
 }
 
 type GojaVMNet struct {
-    vm *GojaVM
+    vm      *GojaVM
+    backend *StorageBackend
 }
 
 func transferGojaArray2GoArray(goArray []interface{}) []interface{} {
@@ -439,6 +445,7 @@ func (n GojaVMNet) SendToOtherPlayer(call goja.FunctionCall) goja.Value {
     return n.vm.Runtime.ToValue(0)
 }
 
+//net.kick(ids, {reason, message}) 先向被踢会话发送告别消息, 再通知网关断开
 func (n GojaVMNet) KillPlayers(call goja.FunctionCall) goja.Value {
     if OnGojaSendSysMessage == nil {
         return n.vm.Runtime.ToValue(-1)
@@ -460,6 +467,30 @@ func (n GojaVMNet) KillPlayers(call goja.FunctionCall) goja.Value {
         return n.vm.Runtime.ToValue(-1)
     }
 
+    reason := int64(0)
+    if len(call.Arguments) > 1 && !goja.IsUndefined(call.Arguments[1]) && !goja.IsNull(call.Arguments[1]) {
+        opts := call.Arguments[1].ToObject(n.vm.Runtime)
+        if v := opts.Get("reason"); v != nil && !goja.IsUndefined(v) && !goja.IsNull(v) {
+            reason = v.ToInteger()
+        }
+        if v := opts.Get("message"); v != nil && !goja.IsUndefined(v) && !goja.IsNull(v) && OnGojaSendMessageTo != nil {
+            farewell, ok := v.Export().(map[string]interface{})
+            if ok {
+                sm := transferGojaMap2GoMap(farewell)
+                sm[int64(messages.ProtocolKeySessionId)] = m
+                OnGojaSendMessageTo(sm)
+            }
+        }
+    }
+
+    for _, sid := range m {
+        markSessionKicked(uint64(codecs.Int64FromInterface(sid)), reason)
+    }
+
+    stacks := make([]goja.StackFrame, 5)
+    logStr := GenGojaStackFrameString(n.vm, fmt.Sprintf("[J] >>> kick sessions %v reason=%d", m, reason), n.vm.Runtime.CaptureCallStack(5, stacks))
+    utils.LogInfo(logStr)
+
     msg := messages.CreateS2SMessage(messages.ProtocolTypeKillClient)
     msg.SetTag(messages.ProtocolTagAdapter)
 
@@ -474,41 +505,16 @@ func (n GojaVMNet) KillPlayers(call goja.FunctionCall) goja.Value {
     return n.vm.Runtime.ToValue(0)
 }
 
+//锁记录在加锁时按需写入, 不再需要storage锁的初始化与销毁, 保留接口兼容旧脚本
 func (n GojaVMNet) InitLock(call goja.FunctionCall) goja.Value {
-    if globalStorage == nil {
-        return n.vm.Runtime.ToValue(false)
-    }
-
-    if len(call.Arguments) == 0 || goja.IsUndefined(call.Arguments[0]) || goja.IsNull(call.Arguments[0]) {
-        return n.vm.Runtime.ToValue(false)
-    }
-
-    key := uint64(call.Arguments[0].ToInteger())
-
-    ok := globalStorage.InitLock(key)
-    return n.vm.Runtime.ToValue(ok)
+    return n.vm.Runtime.ToValue(len(call.Arguments) > 0 && !goja.IsUndefined(call.Arguments[0]) && !goja.IsNull(call.Arguments[0]))
 }
 
 func (n GojaVMNet) DisposeLock(call goja.FunctionCall) goja.Value {
-    if globalStorage == nil {
-        return n.vm.Runtime.ToValue(false)
-    }
-
-    if len(call.Arguments) == 0 || goja.IsUndefined(call.Arguments[0]) || goja.IsNull(call.Arguments[0]) {
-        return n.vm.Runtime.ToValue(false)
-    }
-
-    key := uint64(call.Arguments[0].ToInteger())
-
-    ok := globalStorage.DisposeLock(key)
-    return n.vm.Runtime.ToValue(ok)
+    return n.vm.Runtime.ToValue(len(call.Arguments) > 0 && !goja.IsUndefined(call.Arguments[0]) && !goja.IsNull(call.Arguments[0]))
 }
 
 func (n GojaVMNet) Lock(call goja.FunctionCall) goja.Value {
-    if globalStorage == nil {
-        return n.vm.Runtime.ToValue(-1)
-    }
-
     key := n.vm.defKeyForLock
     if len(call.Arguments) > 0 && !goja.IsUndefined(call.Arguments[0]) && !goja.IsNull(call.Arguments[0]) {
         key = uint64(call.Arguments[0].ToInteger())
@@ -525,102 +531,136 @@ func (n GojaVMNet) Lock(call goja.FunctionCall) goja.Value {
            return n.vm.Runtime.ToValue(-1)
        }*/
 
-    sid, ok := globalStorage.Lock(key)
-    if ok {
-        atomic.AddUint64(&locklogic, 1)
-        n.vm.sidForLock = sid
-        return n.vm.Runtime.ToValue(sid)
-    } else {
-        n.vm.sidForLock = 0
+    //带选项调用时返回{status, sid}, 以区分超时与storage不可用
+    if len(call.Arguments) > 1 && !goja.IsUndefined(call.Arguments[1]) && !goja.IsNull(call.Arguments[1]) {
+        timeout, ttl := n.lockOptions(call, 1)
+        tb := time.Now()
+        sid, status := acquireLock(key, timeout, ttl)
+        n.observeStorage("lock", "sync.lock", []interface{}{key}, tb)
+        if status == LockStatusAcquired {
+            n.vm.trackLock(key, sid)
+        }
+        return n.lockHandle(key, sid, status)
+    }
+
+    if storageClient() == nil {
+        return n.vm.Runtime.ToValue(-1)
+    }
+
+    //成功时返回锁句柄, 其valueOf()为sid, 兼容旧脚本按数字使用的写法
+    tb := time.Now()
+    sid, status := acquireLock(key, 0, 0)
+    n.observeStorage("lock", "sync.lock", []interface{}{key}, tb)
+    if status == LockStatusAcquired {
+        n.vm.trackLock(key, sid)
+        return n.lockHandle(key, sid, status)
     }
 
     return n.vm.Runtime.ToValue(0)
 }
 
 func (n GojaVMNet) Unlock(call goja.FunctionCall) goja.Value {
-    if globalStorage == nil {
+    if storageRawClient() == nil {
         return n.vm.Runtime.ToValue(-1)
     }
 
     key := n.vm.defKeyForLock
-    sid := n.vm.sidForLock
     if len(call.Arguments) > 0 && !goja.IsUndefined(call.Arguments[0]) && !goja.IsNull(call.Arguments[0]) {
         key = uint64(call.Arguments[0].ToInteger())
     }
+
+    sid := int64(0)
     if len(call.Arguments) > 1 && !goja.IsUndefined(call.Arguments[1]) && !goja.IsNull(call.Arguments[1]) {
         sid = call.Arguments[1].ToInteger()
+    } else if held := n.vm.findLock(key); held != nil {
+        sid = held.sid
     }
 
-    if key == n.vm.defKeyForLock && n.vm.sidForLock == 0 {
+    if sid == 0 {
         //utils.LogError("[J] !!! ==> 此时无法归还默认全局锁, 是否在之前并未获取过默认全局锁?")
         return n.vm.Runtime.ToValue(-1)
     }
 
-    if globalStorage.Unlock(sid, key) {
-        atomic.AddUint64(&unlocklogic, 1)
-        n.vm.sidForLock = 0
+    n.vm.untrackLock(key, sid)
+    if releaseLock(key, sid) {
         return n.vm.Runtime.ToValue(0)
     } else {
-        n.vm.sidForLock = 0
         return n.vm.Runtime.ToValue(-1)
     }
 
 }
 
 func (n GojaVMNet) Query(call goja.FunctionCall) goja.Value {
-    if globalStorage == nil {
-        return goja.Null()
-    }
-
     if len(call.Arguments) == 0 {
         return goja.Null()
     }
 
-    sql := call.Arguments[0].String()
-    args := make([]interface{}, 0)
-    if len(call.Arguments) > 1 {
-        for _, a := range call.Arguments[1:] {
-            args = append(args, a.Export())
+    sql, args, opts := n.mysqlStatement(call)
+    return n.runQuery(sql, args, opts)
+}
+
+func (n GojaVMNet) runQuery(sql string, args []interface{}, opts *goja.Object) goja.Value {
+    ttl, tags := queryCacheOptions(opts)
+    cacheKey := ""
+    if ttl > 0 {
+        cacheKey = queryCacheKey(n.backendName(), sql, args)
+        if rows, ok := queryCacheGet(cacheKey); ok {
+            return n.mysqlRows(rows, opts)
         }
     }
 
-    rows, err := globalStorage.DBQuery(sql, args...)
+    sc := n.sql()
+    if sc == nil {
+        n.throwStorageError("mysql.query", ErrorStorageUnavailable)
+        return goja.Null()
+    }
+    tb := time.Now()
+    rows, err := sc.query(sql, args)
+    n.observeStorage("mysql", sql, args, tb)
+    n.recordSQLResult(err)
     if err != nil {
+        n.throwStorageError("mysql.query", err)
         return goja.Null()
     }
 
-    toRows := transferGoArray2GojaArray(rows)
-
-    return n.vm.Runtime.ToValue(toRows)
+    if ttl > 0 {
+        queryCachePut(cacheKey, rows, queryCacheBackendTags(n.backendName(), append(sqlTables(sql), tags...)), ttl)
+    }
+    return n.mysqlRows(rows, opts)
 }
 
 func (n GojaVMNet) Exec(call goja.FunctionCall) goja.Value {
-    if globalStorage == nil {
+    if len(call.Arguments) == 0 {
         return n.vm.Runtime.ToValue(0)
     }
 
-    if len(call.Arguments) == 0 {
+    sql, args, _ := n.mysqlStatement(call)
+    return n.runExec(sql, args)
+}
+
+func (n GojaVMNet) runExec(sql string, args []interface{}) goja.Value {
+    sc := n.sql()
+    if sc == nil {
+        n.throwStorageError("mysql.exec", ErrorStorageUnavailable)
         return n.vm.Runtime.ToValue(0)
     }
-
-    sql := call.Arguments[0].String()
-    args := make([]interface{}, 0)
-    if len(call.Arguments) > 1 {
-        for _, a := range call.Arguments[1:] {
-            args = append(args, a.Export())
-        }
+    tb := time.Now()
+    res, err := sc.exec(sql, args)
+    n.observeStorage("mysql", sql, args, tb)
+    n.recordSQLResult(err)
+    //超时时语句可能已在mysql中执行, 只有SQL错误可以确定数据未变
+    if _, failed := err.(*StorageSQLError); !failed {
+        queryCacheInvalidateSQL(n.backendName(), sql)
     }
-
-    en, err := globalStorage.DBExec(sql, args...)
     if err != nil {
+        n.throwStorageError("mysql.exec", err)
         return n.vm.Runtime.ToValue(0)
     }
-
-    return n.vm.Runtime.ToValue(en)
+    return n.execResult(res)
 }
 
 func (n GojaVMNet) Transaction(call goja.FunctionCall) goja.Value {
-    if globalStorage == nil {
+    if storageClient() == nil {
         return n.vm.Runtime.ToValue(false)
     }
 
@@ -628,7 +668,8 @@ func (n GojaVMNet) Transaction(call goja.FunctionCall) goja.Value {
 }
 
 func (n GojaVMNet) Open(call goja.FunctionCall) goja.Value {
-    if globalStorage == nil {
+    gs := storageClient()
+    if gs == nil {
         return n.vm.Runtime.ToValue(false)
     }
 
@@ -640,12 +681,13 @@ func (n GojaVMNet) Open(call goja.FunctionCall) goja.Value {
     }
 
     n.vm.defKeyForRedis = n.vm.defKeyForLock
-    b := globalStorage.RedisOpen(n.vm.defKeyForRedis)
+    b := gs.RedisOpen(n.vm.defKeyForRedis)
     return n.vm.Runtime.ToValue(b)
 }
 
 func (n GojaVMNet) Close(call goja.FunctionCall) goja.Value {
-    if globalStorage == nil {
+    gs := storageRawClient()
+    if gs == nil {
         return n.vm.Runtime.ToValue(false)
     }
 
@@ -656,7 +698,7 @@ func (n GojaVMNet) Close(call goja.FunctionCall) goja.Value {
         return n.vm.Runtime.ToValue(false)
     }
 
-    b := globalStorage.RedisClose(n.vm.defKeyForRedis)
+    b := gs.RedisClose(n.vm.defKeyForRedis)
     if b {
         n.vm.defKeyForRedis = 0
     }
@@ -664,7 +706,8 @@ func (n GojaVMNet) Close(call goja.FunctionCall) goja.Value {
 }
 
 func (n GojaVMNet) Do(call goja.FunctionCall) goja.Value {
-    if globalStorage == nil {
+    client := n.storage()
+    if client == nil {
         return goja.Null()
     }
 
@@ -672,66 +715,28 @@ func (n GojaVMNet) Do(call goja.FunctionCall) goja.Value {
         return goja.Null()
     }
 
-    cmd := call.Arguments[0].String()
-    args := make([]interface{}, 0)
-    if len(call.Arguments) > 1 {
-        for _, a := range call.Arguments[1:] {
-            v := a.Export()
-            switch v.(type) {
-            case map[string]interface{}:
-                var sv codecs.IMData = transferGojaMap2GoMap(v.(map[string]interface{}))
-                err, bs := codecs.CodecIMv2.Encoder.Encode(&sv)
-                if err == nil {
-                    args = append(args, bs)
-                    continue
-                }
-            case []interface{}:
-                var sv codecs.IMData = transferGojaArray2GoArray(v.([]interface{}))
-                err, bs := codecs.CodecIMv2.Encoder.Encode(&sv)
-                if err == nil {
-                    args = append(args, bs)
-                    continue
-                }
-            }
-            args = append(args, v)
-        }
-    }
-
-    rows := globalStorage.RedisDo(cmd, args...)
-    if rows == nil {
-        return goja.Null()
-    }
-
-    switch rows.(type) {
-    case string:
-        return n.vm.Runtime.ToValue(rows)
-    case []byte:
-        bs, ok := rows.([]byte)
-        if ok {
-            err, obj, remain := codecs.CodecIMv2.Decoder.Decode(bs)
-            if err == nil && len(remain) == 0 {
-                switch obj.(type) {
-                case map[interface{}]interface{}:
-                    return n.vm.Runtime.ToValue(transferGoMap2GojaMap(obj.(map[interface{}]interface{})))
-                case []interface{}:
-                    return n.vm.Runtime.ToValue(transferGoArray2GojaArray(obj.([]interface{})))
-                }
-                return n.vm.Runtime.ToValue(obj)
-            }
+    //redis.cmd({decode: true}, cmd, ...args) 显式要求将结果按IMv2解码
+    decode := false
+    if _, ok := call.Arguments[0].(*goja.Object); ok {
+        decode = redisDecodeOption(call.Arguments[0])
+        call.Arguments = call.Arguments[1:]
+        if len(call.Arguments) == 0 {
+            return goja.Null()
         }
-        return n.vm.Runtime.ToValue(string(rows.([]byte)))
-
-    case map[interface{}]interface{}:
-        return n.vm.Runtime.ToValue(transferGoMap2GojaMap(rows.(map[interface{}]interface{})))
-    case []interface{}:
-        return n.vm.Runtime.ToValue(transferGoArray2GojaArray(rows.([]interface{})))
     }
 
-    return n.vm.Runtime.ToValue(rows)
+    cmd := call.Arguments[0].String()
+    args := namespaceRedisArgs(cmd, redisArgs(call.Arguments[1:]))
+    tb := time.Now()
+    rows := unnamespaceRedisReply(cmd, client.RedisDo(cmd, args...))
+    n.observeStorage("redis", strings.ToUpper(cmd), args, tb)
+    n.recordStorageResult(rows != nil, tb)
+    return redisValue(n.vm, rows, decode)
 }
 
 func (n GojaVMNet) DoRaw(call goja.FunctionCall) goja.Value {
-    if globalStorage == nil {
+    client := n.storage()
+    if client == nil {
         return goja.Null()
     }
 
@@ -754,7 +759,11 @@ func (n GojaVMNet) DoRaw(call goja.FunctionCall) goja.Value {
         }
     }
 
-    rows := globalStorage.RedisDo(cmd, args...)
+    args = namespaceRedisArgs(cmd, args)
+    tb := time.Now()
+    rows := unnamespaceRedisReply(cmd, client.RedisDo(cmd, args...))
+    n.observeStorage("redis", strings.ToUpper(cmd), args, tb)
+    n.recordStorageResult(rows != nil, tb)
     if rows == nil {
         return goja.Null()
     }
@@ -775,7 +784,8 @@ func (n GojaVMNet) DoRaw(call goja.FunctionCall) goja.Value {
 }
 
 func (n GojaVMNet) Send(call goja.FunctionCall) goja.Value {
-    if globalStorage == nil {
+    gs := storageClient()
+    if gs == nil {
         return n.vm.Runtime.ToValue(false)
     }
 
@@ -798,12 +808,13 @@ func (n GojaVMNet) Send(call goja.FunctionCall) goja.Value {
         }
     }
 
-    b := globalStorage.RedisSend(n.vm.defKeyForRedis, cmd, args...)
+    b := gs.RedisSend(n.vm.defKeyForRedis, cmd, namespaceRedisArgs(cmd, args)...)
     return n.vm.Runtime.ToValue(b)
 }
 
 func (n GojaVMNet) Flush(call goja.FunctionCall) goja.Value {
-    if globalStorage == nil {
+    gs := storageClient()
+    if gs == nil {
         return n.vm.Runtime.ToValue(false)
     }
 
@@ -814,15 +825,13 @@ func (n GojaVMNet) Flush(call goja.FunctionCall) goja.Value {
         return n.vm.Runtime.ToValue(false)
     }
 
-    b := globalStorage.RedisFlush(n.vm.defKeyForRedis)
-    if b {
-        n.vm.defKeyForRedis = 0
-    }
+    b := gs.RedisFlush(n.vm.defKeyForRedis)
     return n.vm.Runtime.ToValue(b)
 }
 
 func (n GojaVMNet) Receive(call goja.FunctionCall) goja.Value {
-    if globalStorage == nil {
+    gs := storageClient()
+    if gs == nil {
         return goja.Null()
     }
 
@@ -833,11 +842,8 @@ func (n GojaVMNet) Receive(call goja.FunctionCall) goja.Value {
         return goja.Null()
     }
 
-    row := globalStorage.RedisReceive(n.vm.defKeyForRedis)
-    if row == nil {
-        return goja.Null()
-    }
-    return n.vm.Runtime.ToValue(row)
+    row := gs.RedisReceive(n.vm.defKeyForRedis)
+    return redisValue(n.vm, row, redisDecodeOption(call.Argument(0)))
 }
 
 type GojaVM struct {
@@ -847,13 +853,18 @@ type GojaVM struct {
     associatedSessionId  uint64
     defKeyForLock        uint64
     defKeyForRedis       uint64
-    sidForLock           int64
+    heldLocks            []*heldLock
+    heldLocksLock        sync.Mutex
+    redisConns           []*redisConn
     consumer             *sourcemap.Consumer
 }
 
 ///此channel用来确保只有唯一一个vm上下文的init会被执行
 var gojaInitCallbackCh chan int
 
+///仅在__init__执行期间为true, 用于限制只能在初始化时声明的全局配置(如定时任务)
+var gojaInitializing = false
+
 func GojaInit() {
     gojaInitCallbackCh = make(chan int)
     go func() {
@@ -869,6 +880,13 @@ func GenGojaExceptionString(vm *GojaVM, jserr *goja.Exception) string {
 
     for i, stack := range jserr.Stacks() {
         b.WriteString("\tat ")
+        if vm.consumer == nil {
+            b.WriteString(stack.SrcName())
+            b.WriteByte(':')
+            b.WriteString(stack.Position().String())
+            b.WriteByte('\n')
+            continue
+        }
         source, _, line, column, ok := vm.consumer.Source(stack.Position().Line, stack.Position().Col)
         if ok {
             b.WriteString(source)
@@ -897,6 +915,14 @@ func GenGojaStackFrameString(vm *GojaVM, title string, stacks []goja.StackFrame)
 
     var ii = 0
     for _, stack := range stacks {
+        if vm.consumer == nil {
+            b.WriteString("\tat ")
+            b.WriteString(stack.SrcName())
+            b.WriteByte(':')
+            b.WriteString(stack.Position().String())
+            b.WriteByte('\n')
+            continue
+        }
         source, _, line, column, ok := vm.consumer.Source(stack.Position().Line, stack.Position().Col)
         if ok {
             b.WriteString("\tat ")
@@ -935,14 +961,12 @@ func (vm *GojaVM) SetValue(name string, val interface{}) {
     if name == "CurrentSessionId" {
         s := uint64(codecs.Int64FromInterface(val))
         if s == 0 {
-            if vm.sidForLock > 0 {
-                globalStorage.Unlock(vm.sidForLock, vm.defKeyForLock)
-            }
-            if vm.defKeyForRedis > 0 {
-                globalStorage.RedisClose(vm.defKeyForRedis)
+            vm.releaseAllLocks()
+            vm.closeAllRedisConns()
+            if gs := storageRawClient(); gs != nil && vm.defKeyForRedis > 0 {
+                gs.RedisClose(vm.defKeyForRedis)
             }
         }
-        vm.sidForLock = 0
         vm.defKeyForLock = s
         vm.defKeyForRedis = 0
     }
@@ -970,6 +994,7 @@ func (vm *GojaVM) Load(path string) bool {
 
     gojaRequire.Enable(vm.Runtime)
     EnableConsole(vm.Runtime)
+    vm.defineErrorTypes()
 
     gn := &GojaVMNet{vm: vm}
     objGS := vm.Runtime.NewObject()
@@ -990,6 +1015,8 @@ func (vm *GojaVM) Load(path string) bool {
     objNet.Set("deliver", gn.SendToOtherPlayer)
     objNet.Set("kick", gn.KillPlayers)
     objNet.Set("test", gn.TestValue)
+    objNet.Set("sessions", gn.Sessions)
+    objNet.Set("info", gn.SessionInfo)
     vm.Runtime.Set("net", objNet)
 
     objLock := vm.Runtime.NewObject()
@@ -997,11 +1024,23 @@ func (vm *GojaVM) Load(path string) bool {
     objLock.Set("dispose", gn.DisposeLock)
     objLock.Set("lock", gn.Lock)
     objLock.Set("unlock", gn.Unlock)
+    objLock.Set("tryLock", gn.TryLock)
+    objLock.Set("withLock", gn.WithLock)
+    objLock.Set("renew", gn.RenewLock)
+    objLock.Set("ACQUIRED", LockStatusAcquired)
+    objLock.Set("TIMEOUT", LockStatusTimeout)
+    objLock.Set("UNAVAILABLE", LockStatusUnavailable)
     vm.Runtime.Set("sync", objLock)
 
     objDB := vm.Runtime.NewObject()
     objDB.Set("query", gn.Query)
     objDB.Set("exec", gn.Exec)
+    objDB.Set("invalidate", gn.Invalidate)
+    objDB.Set("insert", gn.Insert)
+    objDB.Set("update", gn.Update)
+    objDB.Set("select", gn.Select)
+    objDB.Set("upsert", gn.Upsert)
+    objDB.Set("use", gn.UseMysql)
     objDB.Set("transaction", gn.Transaction)
     vm.Runtime.Set("mysql", objDB)
 
@@ -1013,8 +1052,57 @@ func (vm *GojaVM) Load(path string) bool {
     objRedis.Set("send", gn.Send)
     objRedis.Set("flush", gn.Flush)
     objRedis.Set("receive", gn.Receive)
+    objRedis.Set("pipeline", gn.Pipeline)
+    objRedis.Set("batch", gn.Batch)
+    objRedis.Set("connect", gn.Connect)
+    objRedis.Set("use", gn.UseRedis)
+    gn.defineRedisScripts(objRedis)
+    objRedis.Set("subscribe", gn.Subscribe)
     vm.Runtime.Set("redis", objRedis)
 
+    objCrypto := vm.Runtime.NewObject()
+    objCrypto.Set("md5", gn.cryptoDigest("md5"))
+    objCrypto.Set("sha1", gn.cryptoDigest("sha1"))
+    objCrypto.Set("sha256", gn.cryptoDigest("sha256"))
+    objCrypto.Set("sha512", gn.cryptoDigest("sha512"))
+    objCrypto.Set("hash", gn.Hash)
+    objCrypto.Set("hmac", gn.Hmac)
+    objCrypto.Set("equal", gn.SafeEqual)
+    objCrypto.Set("randomBytes", gn.RandomBytes)
+    objCrypto.Set("randomInt", gn.RandomInt)
+    objCrypto.Set("uuid", gn.UUID)
+    objCrypto.Set("hexEncode", gn.HexEncode)
+    objCrypto.Set("hexDecode", gn.HexDecode)
+    objCrypto.Set("base64Encode", gn.Base64Encode)
+    objCrypto.Set("base64Decode", gn.Base64Decode)
+    objCrypto.Set("text", gn.BytesToString)
+    objCrypto.Set("hashPassword", gn.HashPassword)
+    objCrypto.Set("verifyPassword", gn.VerifyPassword)
+    vm.Runtime.Set("crypto", objCrypto)
+
+    objRooms := vm.Runtime.NewObject()
+    objRooms.Set("create", gn.RoomCreate)
+    objRooms.Set("destroy", gn.RoomDestroy)
+    objRooms.Set("join", gn.RoomJoin)
+    objRooms.Set("leave", gn.RoomLeave)
+    objRooms.Set("members", gn.RoomMembers)
+    objRooms.Set("list", gn.RoomList)
+    objRooms.Set("broadcast", gn.RoomBroadcast)
+    vm.Runtime.Set("rooms", objRooms)
+
+    objRPC := vm.Runtime.NewObject()
+    objRPC.Set("call", gn.RPCCall)
+    vm.Runtime.Set("rpc", objRPC)
+
+    objCron := vm.Runtime.NewObject()
+    objCron.Set("add", gn.CronAdd)
+    objCron.Set("remove", gn.CronRemove)
+    vm.Runtime.Set("cron", objCron)
+
+    objHttp := vm.Runtime.NewObject()
+    objHttp.Set("request", gn.HttpRequest)
+    vm.Runtime.Set("http", objHttp)
+
     _, err = vm.Runtime.RunScript(path, string(fbs))
     if err != nil {
         if jserr, ok := err.(*goja.Exception); ok {
@@ -1033,7 +1121,9 @@ func (vm *GojaVM) Load(path string) bool {
         if ok {
             _, ok := <-gojaInitCallbackCh
             if ok {
+                gojaInitializing = true
                 r, err := init(goja.Undefined())
+                gojaInitializing = false
                 if err != nil {
                     if jserr, ok := err.(*goja.Exception); ok {
                         utils.LogError("[J] %s", GenGojaExceptionString(vm, jserr))
@@ -1120,7 +1210,7 @@ func (vm *GojaVM) DispatchLeave(sessionId uint64, addr string) int {
     }
     enter, ok := goja.AssertFunction(gojaEnter)
     if ok {
-        _, err := enter(goja.Undefined(), vm.Runtime.ToValue(sessionId), vm.Runtime.ToValue(addr))
+        _, err := enter(goja.Undefined(), vm.Runtime.ToValue(sessionId), vm.Runtime.ToValue(addr), vm.Runtime.ToValue(sessionKickReason(sessionId)))
         if err != nil {
             if jserr, ok := err.(*goja.Exception); ok {
                 utils.LogError("[J] %s", GenGojaExceptionString(vm, jserr))
@@ -1205,3 +1295,224 @@ func (vm *GojaVM) DispatchMessage(sessionId uint64, msg map[interface{}]interfac
     }
     return 0
 }
+
+func gojaValueToBytes(v goja.Value) []byte {
+    if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+        return nil
+    }
+    obj, ok := v.(*goja.Object)
+    if ok {
+        if ab, ok := obj.Export().(goja.ArrayBuffer); ok {
+            return ab.Bytes()
+        }
+        buf := obj.Get("buffer")
+        if buf != nil {
+            if ab, ok := buf.Export().(goja.ArrayBuffer); ok {
+                bs := ab.Bytes()
+                offset := int(obj.Get("byteOffset").ToInteger())
+                length := int(obj.Get("byteLength").ToInteger())
+                if offset >= 0 && length >= 0 && offset+length <= len(bs) {
+                    return bs[offset : offset+length]
+                }
+                return bs
+            }
+        }
+    }
+    return []byte(v.String())
+}
+
+func gojaBytesValue(vm *GojaVM, bs []byte) goja.Value {
+    ab := vm.Runtime.NewArrayBuffer(bs)
+    u8, err := vm.Runtime.New(vm.Runtime.Get("Uint8Array"), vm.Runtime.ToValue(ab))
+    if err != nil {
+        return vm.Runtime.ToValue(ab)
+    }
+    return u8
+}
+
+func (vm *GojaVM) DispatchAdmin(command string, args interface{}) (json.RawMessage, error) {
+    gojaAdmin := vm.Runtime.Get("__admin__")
+    if gojaAdmin == nil || goja.IsUndefined(gojaAdmin) {
+        return nil, errors.New("script does not export __admin__")
+    }
+    admin, ok := goja.AssertFunction(gojaAdmin)
+    if !ok {
+        return nil, errors.New("__admin__ is not a function")
+    }
+    r, err := admin(goja.Undefined(), vm.Runtime.ToValue(command), vm.Runtime.ToValue(args))
+    if err != nil {
+        if jserr, ok := err.(*goja.Exception); ok {
+            utils.LogError("[J] %s", GenGojaExceptionString(vm, jserr))
+            return nil, errors.New(jserr.Value().String())
+        }
+        return nil, err
+    }
+    if r == nil || goja.IsUndefined(r) {
+        return nil, nil
+    }
+    //goja中的非ASCII字符串以UTF-16保存, 直接序列化Value会得到编码数组, 需先导出为Go值
+    bs, err := json.Marshal(r.Export())
+    if err != nil {
+        return nil, err
+    }
+    return json.RawMessage(bs), nil
+}
+
+func (vm *GojaVM) DispatchTick(now time.Time, dt time.Duration) int {
+    gojaTick := vm.Runtime.Get("__tick__")
+    if gojaTick == nil || goja.IsUndefined(gojaTick) {
+        return -1
+    }
+    tick, ok := goja.AssertFunction(gojaTick)
+    if ok {
+        _, err := tick(goja.Undefined(), vm.Runtime.ToValue(now.UnixNano()/int64(time.Millisecond)), vm.Runtime.ToValue(int64(dt/time.Millisecond)))
+        if err != nil {
+            if jserr, ok := err.(*goja.Exception); ok {
+                utils.LogError("[J] %s", GenGojaExceptionString(vm, jserr))
+            }
+        }
+    }
+    return 0
+}
+
+func (vm *GojaVM) DispatchCron(name string, now time.Time) int {
+    gojaCron := vm.Runtime.Get("__cron__")
+    if gojaCron == nil || goja.IsUndefined(gojaCron) {
+        return -1
+    }
+    cron, ok := goja.AssertFunction(gojaCron)
+    if ok {
+        _, err := cron(goja.Undefined(), vm.Runtime.ToValue(name), vm.Runtime.ToValue(now.UnixNano()/int64(time.Millisecond)))
+        if err != nil {
+            if jserr, ok := err.(*goja.Exception); ok {
+                utils.LogError("[J] %s", GenGojaExceptionString(vm, jserr))
+            }
+        }
+    }
+    return 0
+}
+
+const (
+    RequestErrorCodeScript = 1
+)
+
+//带序列号的客户端请求交由__request__处理, 返回值(或抛出的异常)自动回复给当前会话
+func (vm *GojaVM) DispatchRequest(sessionId uint64, msg map[interface{}]interface{}) int {
+    gojaRequest := vm.Runtime.Get("__request__")
+    if gojaRequest == nil || goja.IsUndefined(gojaRequest) {
+        return -1
+    }
+    request, ok := goja.AssertFunction(gojaRequest)
+    if !ok {
+        return -1
+    }
+
+    reqMsg, err := messages.MessageFromData(nil, "", msg)
+    if err != nil || reqMsg == nil {
+        return -1
+    }
+
+    rspMsg := messages.CreateC2SReturnMessage(reqMsg)
+    rspMsg.SetTag(messages.ProtocolTagClient)
+    rspMsg.SetSessionId([]nnet.SessionID{sessionId})
+
+    r, err := request(goja.Undefined(), vm.Runtime.ToValue(sessionId), vm.Runtime.ToValue(transferGoMap2GojaMap(msg)))
+    if err != nil {
+        code := int64(RequestErrorCodeScript)
+        errMsg := err.Error()
+        if jserr, ok := err.(*goja.Exception); ok {
+            utils.LogError("[J] %s", GenGojaExceptionString(vm, jserr))
+            errMsg = jserr.Value().String()
+            if obj, ok := jserr.Value().(*goja.Object); ok {
+                if v := obj.Get("code"); v != nil && !goja.IsUndefined(v) && !goja.IsNull(v) && v.ToInteger() != 0 {
+                    code = v.ToInteger()
+                }
+                if v := obj.Get("message"); v != nil && !goja.IsUndefined(v) {
+                    errMsg = v.String()
+                }
+            }
+        }
+        rspMsg.SetErrorCode(int(code))
+        rspMsg.SetBody(codecs.IMMap{"message": errMsg})
+    } else {
+        rspMsg.SetErrorCode(messages.ProtocolErrorCodeOK)
+        body := make(codecs.IMMap)
+        if r != nil && !goja.IsUndefined(r) && !goja.IsNull(r) {
+            switch v := r.Export().(type) {
+            case map[string]interface{}:
+                body = transferGojaMap2GoMap(v)
+            case []interface{}:
+                body[messages.ProtocolKeyValue] = transferGojaArray2GoArray(v)
+            default:
+                body[messages.ProtocolKeyValue] = v
+            }
+        }
+        rspMsg.SetBody(body)
+    }
+
+    if OnGojaSendMessage != nil {
+        rspData, err := messages.DataFromMessage(rspMsg)
+        if err == nil {
+            OnGojaSendMessage(vm.associatedSourceAddr, vm.associatedSourceId, rspData)
+        }
+    }
+    return 0
+}
+
+func (vm *GojaVM) DispatchRPC(method string, args interface{}, caller int64) (interface{}, int, error) {
+    gojaRPC := vm.Runtime.Get("__rpc__")
+    if gojaRPC == nil || goja.IsUndefined(gojaRPC) {
+        return nil, RPCErrorCodeNoHandle, errors.New("script does not export __rpc__")
+    }
+    rpc, ok := goja.AssertFunction(gojaRPC)
+    if !ok {
+        return nil, RPCErrorCodeNoHandle, errors.New("__rpc__ is not a function")
+    }
+
+    var jsArgs goja.Value
+    switch v := args.(type) {
+    case map[interface{}]interface{}:
+        jsArgs = vm.Runtime.ToValue(transferGoMap2GojaMap(v))
+    case []interface{}:
+        jsArgs = vm.Runtime.ToValue(transferGoArray2GojaArray(v))
+    default:
+        jsArgs = vm.Runtime.ToValue(v)
+    }
+
+    r, err := rpc(goja.Undefined(), vm.Runtime.ToValue(method), jsArgs, vm.Runtime.ToValue(caller))
+    if err != nil {
+        if jserr, ok := err.(*goja.Exception); ok {
+            utils.LogError("[J] %s", GenGojaExceptionString(vm, jserr))
+            return nil, RPCErrorCodeScript, errors.New(jserr.Value().String())
+        }
+        return nil, RPCErrorCodeScript, err
+    }
+    if r == nil || goja.IsUndefined(r) || goja.IsNull(r) {
+        return nil, 0, nil
+    }
+    switch v := r.Export().(type) {
+    case map[string]interface{}:
+        return transferGojaMap2GoMap(v), 0, nil
+    case []interface{}:
+        return transferGojaArray2GoArray(v), 0, nil
+    default:
+        return v, 0, nil
+    }
+}
+
+func (vm *GojaVM) DispatchEvent(channel string, payload string) int {
+    gojaEvent := vm.Runtime.Get("__event__")
+    if gojaEvent == nil || goja.IsUndefined(gojaEvent) {
+        return -1
+    }
+    event, ok := goja.AssertFunction(gojaEvent)
+    if ok {
+        _, err := event(goja.Undefined(), vm.Runtime.ToValue(channel), vm.Runtime.ToValue(payload))
+        if err != nil {
+            if jserr, ok := err.(*goja.Exception); ok {
+                utils.LogError("[J] %s", GenGojaExceptionString(vm, jserr))
+            }
+        }
+    }
+    return 0
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "github.com/packing/clove/utils"
+    "github.com/packing/goja"
+)
+
+var (
+    httpAllowHosts []string
+    httpMaxTimeout = 5 * time.Second
+    httpMaxBody    int64 = 5242880
+
+    httpMaxRedirects = 10
+
+    httpClient = &http.Client{CheckRedirect: checkHttpRedirect}
+)
+
+func setHttpAllowHosts(hosts string) {
+    httpAllowHosts = httpAllowHosts[:0]
+    for _, h := range strings.Split(hosts, ",") {
+        h = strings.ToLower(strings.TrimSpace(h))
+        if h != "" {
+            httpAllowHosts = append(httpAllowHosts, h)
+        }
+    }
+}
+
+//支持精确匹配与 *.example.com 形式的后缀匹配
+func isHttpHostAllowed(host string) bool {
+    host = strings.ToLower(host)
+    for _, h := range httpAllowHosts {
+        if h == host {
+            return true
+        }
+        if strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+            return true
+        }
+    }
+    return false
+}
+
+//跳转的每一跳都经过白名单检查, 否则白名单内的主机可以把请求引向内网地址
+func checkHttpRedirect(req *http.Request, via []*http.Request) error {
+    if len(via) >= httpMaxRedirects {
+        return fmt.Errorf("stopped after %d redirects", httpMaxRedirects)
+    }
+    if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+        return fmt.Errorf("redirect to invalid url %s", req.URL)
+    }
+    if !isHttpHostAllowed(req.URL.Hostname()) {
+        return fmt.Errorf("redirect to host %s is not allowed", req.URL.Hostname())
+    }
+    return nil
+}
+
+func (n GojaVMNet) httpError(title string) goja.Value {
+    stacks := make([]goja.StackFrame, 5)
+    errStr := GenGojaStackFrameString(n.vm, "[J] !!! "+title, n.vm.Runtime.CaptureCallStack(5, stacks))
+    utils.LogError(errStr)
+    return goja.Null()
+}
+
+func (n GojaVMNet) HttpRequest(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 || goja.IsUndefined(call.Arguments[0]) || goja.IsNull(call.Arguments[0]) {
+        return goja.Null()
+    }
+
+    opts := call.Arguments[0].ToObject(n.vm.Runtime)
+
+    method := "GET"
+    if v := opts.Get("method"); v != nil && !goja.IsUndefined(v) && !goja.IsNull(v) {
+        method = strings.ToUpper(v.String())
+    }
+
+    v := opts.Get("url")
+    if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+        return n.httpError("Http request without url")
+    }
+    u, err := url.Parse(v.String())
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+        return n.httpError("Http request with invalid url " + v.String())
+    }
+    if !isHttpHostAllowed(u.Hostname()) {
+        return n.httpError("Http host is not allowed " + u.Hostname())
+    }
+
+    timeout := httpMaxTimeout
+    if v := opts.Get("timeout"); v != nil && !goja.IsUndefined(v) && !goja.IsNull(v) {
+        t := time.Duration(v.ToInteger()) * time.Millisecond
+        if t > 0 && t < timeout {
+            timeout = t
+        }
+    }
+
+    var body []byte
+    if v := opts.Get("body"); v != nil && !goja.IsUndefined(v) && !goja.IsNull(v) {
+        body = gojaValueToBytes(v)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+    if err != nil {
+        return n.httpError("Http request error " + err.Error())
+    }
+
+    if v := opts.Get("headers"); v != nil && !goja.IsUndefined(v) && !goja.IsNull(v) {
+        headers := v.ToObject(n.vm.Runtime)
+        for _, k := range headers.Keys() {
+            req.Header.Set(k, headers.Get(k).String())
+        }
+    }
+
+    rsp, err := httpClient.Do(req)
+    if err != nil {
+        return n.httpError("Http request error " + err.Error())
+    }
+    defer rsp.Body.Close()
+
+    data, err := ioutil.ReadAll(http.MaxBytesReader(nil, rsp.Body, httpMaxBody))
+    if err != nil {
+        return n.httpError("Http response error " + err.Error())
+    }
+
+    headers := make(map[string]interface{})
+    for k := range rsp.Header {
+        headers[strings.ToLower(k)] = rsp.Header.Get(k)
+    }
+
+    ret := n.vm.Runtime.NewObject()
+    ret.Set("status", rsp.StatusCode)
+    ret.Set("headers", headers)
+    if v := opts.Get("binary"); v != nil && v.ToBoolean() {
+        ret.Set("body", gojaBytesValue(n.vm, data))
+    } else {
+        ret.Set("body", string(data))
+    }
+    return ret
+}
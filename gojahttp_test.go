@@ -0,0 +1,110 @@
+package main
+
+import (
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/packing/goja"
+)
+
+func newHttpTestVM(t *testing.T, srv *httptest.Server) *GojaVM {
+    vm := &GojaVM{Runtime: goja.New()}
+    vm.Runtime.Set("request", GojaVMNet{vm: vm}.HttpRequest)
+    vm.Runtime.Set("base", srv.URL)
+    setHttpAllowHosts("127.0.0.1")
+    t.Cleanup(func() {
+        setHttpAllowHosts("")
+    })
+    return vm
+}
+
+func runHttpScript(t *testing.T, vm *GojaVM, src string) goja.Value {
+    v, err := vm.Runtime.RunString(src)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return v
+}
+
+func newHttpTestServer() *httptest.Server {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+        body, _ := ioutil.ReadAll(r.Body)
+        w.Header().Set("X-Method", r.Method)
+        w.Header().Set("X-Token", r.Header.Get("X-Token"))
+        w.WriteHeader(201)
+        w.Write(body)
+    })
+    mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+        time.Sleep(300 * time.Millisecond)
+        w.Write([]byte("late"))
+    })
+    mux.HandleFunc("/redirect/allowed", func(w http.ResponseWriter, r *http.Request) {
+        http.Redirect(w, r, "/echo", http.StatusFound)
+    })
+    //localhost指向同一台服务器, 但不在白名单中
+    mux.HandleFunc("/redirect/internal", func(w http.ResponseWriter, r *http.Request) {
+        http.Redirect(w, r, "http://localhost:"+r.URL.Query().Get("port")+"/echo", http.StatusFound)
+    })
+    return httptest.NewServer(mux)
+}
+
+func TestHttpRequest(t *testing.T) {
+    srv := newHttpTestServer()
+    defer srv.Close()
+    vm := newHttpTestVM(t, srv)
+
+    v := runHttpScript(t, vm, `
+        var r = request({method: "post", url: base + "/echo", headers: {"X-Token": "t1"}, body: "hello"});
+        [r.status, r.headers["x-method"], r.headers["x-token"], r.body].join(",")`)
+    if got := v.String(); got != "201,POST,t1,hello" {
+        t.Errorf("got %s", got)
+    }
+}
+
+func TestHttpRequestHostNotAllowed(t *testing.T) {
+    srv := newHttpTestServer()
+    defer srv.Close()
+    vm := newHttpTestVM(t, srv)
+    setHttpAllowHosts("example.com")
+
+    if v := runHttpScript(t, vm, `request({url: base + "/echo"})`); !goja.IsNull(v) {
+        t.Errorf("got %v, want null", v)
+    }
+}
+
+func TestHttpRequestRedirect(t *testing.T) {
+    srv := newHttpTestServer()
+    defer srv.Close()
+    vm := newHttpTestVM(t, srv)
+
+    if v := runHttpScript(t, vm, `request({url: base + "/redirect/allowed"}).status`); v.ToInteger() != 201 {
+        t.Errorf("got %v, want 201", v)
+    }
+    if v := runHttpScript(t, vm, `request({url: base + "/redirect/internal?port=" + base.split(":")[2]})`); !goja.IsNull(v) {
+        t.Errorf("redirect to a host outside the allow-list: got %v, want null", v)
+    }
+}
+
+func TestHttpRequestTimeout(t *testing.T) {
+    srv := newHttpTestServer()
+    defer srv.Close()
+    vm := newHttpTestVM(t, srv)
+
+    if v := runHttpScript(t, vm, `request({url: base + "/slow", timeout: 50})`); !goja.IsNull(v) {
+        t.Errorf("got %v, want null", v)
+    }
+
+    //超过上限的timeout按上限处理
+    old := httpMaxTimeout
+    httpMaxTimeout = 50 * time.Millisecond
+    defer func() {
+        httpMaxTimeout = old
+    }()
+    if v := runHttpScript(t, vm, `request({url: base + "/slow", timeout: 10000})`); !goja.IsNull(v) {
+        t.Errorf("got %v, want null", v)
+    }
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+    "strings"
+    "time"
+
+    "github.com/packing/clove/storage"
+    "github.com/packing/clove/utils"
+)
+
+const (
+    StorageStateUp       = "up"
+    StorageStateDown     = "down"
+    StorageStateHalfOpen = "halfOpen"
+
+    //连续失败达到次数后熔断, 熔断期间调用立即失败, 由健康检查负责恢复
+    storageFailThreshold = 3
+
+    //重连后关闭旧客户端前额外等待的时间
+    storageRetireMargin = time.Second
+)
+
+type StorageHealth struct {
+    State       string `json:"state"`
+    Since       int64  `json:"since"`
+    Failures    int    `json:"failures"`
+    Outages     uint64 `json:"outages"`
+    DowntimeMs  int64  `json:"downtimeMs"`
+    Reconnects  uint64 `json:"reconnects"`
+    Rejected    uint64 `json:"rejected"`
+    LastCheckMs int64  `json:"lastCheckMs"`
+    LastCheckAt int64  `json:"lastCheckAt"`
+}
+
+var (
+    storageCheckInterval = 5 * time.Second
+
+    storageHealthStopCh chan int
+)
+
+//当前使用的客户端; 重连时替换为新的客户端, 创建成功后不会再置为nil
+func (b *StorageBackend) Client() *storage.Client {
+    b.lock.RLock()
+    defer b.lock.RUnlock()
+    return b.client
+}
+
+//熔断打开时返回nil, 调用方按storage不可用处理
+func (b *StorageBackend) Available() *storage.Client {
+    b.lock.RLock()
+    c, down := b.client, b.health.State == StorageStateDown
+    b.lock.RUnlock()
+    if !down {
+        return c
+    }
+    b.lock.Lock()
+    b.health.Rejected++
+    b.lock.Unlock()
+    return nil
+}
+
+//unix管道为无连接的数据报, storage重启后无需重建; tcp模式需要重新建立连接
+func (b *StorageBackend) Unavailable() bool {
+    b.lock.RLock()
+    defer b.lock.RUnlock()
+    return b.client == nil || b.health.State == StorageStateDown
+}
+
+func (b *StorageBackend) isTCP() bool {
+    return strings.Contains(b.Addr, ":")
+}
+
+func (b *StorageBackend) SQL() *sqlChannel {
+    b.lock.RLock()
+    defer b.lock.RUnlock()
+    return b.sql
+}
+
+func (b *StorageBackend) connect() bool {
+    c := storage.CreateClientWithBufferSize(b.Addr, b.Timeout, b.Buffer, b.Buffer)
+    if c == nil {
+        return false
+    }
+    sc, err := createSQLChannel(b.Name, b.Addr, b.Timeout, b.Buffer)
+    if err != nil {
+        utils.LogError("!!!无法创建storage %s 的mysql通道 %s", b.Name, err.Error())
+        c.Close()
+        return false
+    }
+    b.lock.Lock()
+    old, oldSQL := b.client, b.sql
+    b.client, b.sql = c, sc
+    b.lock.Unlock()
+    if old != nil {
+        b.retire(old)
+    }
+    //mysql通道的等待通道不会被关闭, 可以直接关闭
+    if oldSQL != nil {
+        oldSQL.close()
+    }
+    return true
+}
+
+//其他上下文可能仍在旧客户端上等待结果, Close会关闭这些等待通道, 之后到期的定时器
+//或迟到的回复再向其发送会导致panic. 替换后等待所有请求都已超时再关闭旧客户端
+func (b *StorageBackend) retire(c *storage.Client) {
+    time.AfterFunc(2*b.Timeout+storageRetireMargin, func() {
+        defer func() {
+            utils.LogPanic(recover())
+        }()
+        c.Close()
+    })
+}
+
+func (b *StorageBackend) close() {
+    b.lock.Lock()
+    c, sc := b.client, b.sql
+    b.lock.Unlock()
+    if c != nil {
+        c.Close()
+    }
+    if sc != nil {
+        sc.close()
+    }
+}
+
+func (b *StorageBackend) setState(state string) {
+    now := time.Now()
+    b.lock.Lock()
+    prev := b.health.State
+    if prev == state {
+        b.lock.Unlock()
+        return
+    }
+    b.health.State = state
+    b.health.Since = now.UnixNano() / int64(time.Millisecond)
+    switch {
+    case state == StorageStateDown && prev != StorageStateHalfOpen:
+        b.health.Outages++
+        b.downAt = now
+    case state == StorageStateUp && !b.downAt.IsZero():
+        b.health.DowntimeMs += int64(now.Sub(b.downAt) / time.Millisecond)
+        b.downAt = time.Time{}
+    }
+    b.lock.Unlock()
+
+    utils.LogWarn(">>> storage %s (%s) 状态 %s => %s", b.Name, b.Addr, prev, state)
+    if b == defaultStorage && tcpCtrl != nil {
+        reportState()
+    }
+}
+
+//脚本调用超时计入失败次数, 连续失败达到阈值后熔断
+func (b *StorageBackend) recordFailure() {
+    b.lock.Lock()
+    b.health.Failures++
+    trip := b.health.Failures >= storageFailThreshold && b.health.State == StorageStateUp
+    b.lock.Unlock()
+    if trip {
+        b.setState(StorageStateDown)
+    }
+}
+
+func (b *StorageBackend) recordSuccess() {
+    b.lock.Lock()
+    b.health.Failures = 0
+    b.lock.Unlock()
+}
+
+//storage对SQL错误同样有回复, 只有等待超时计为失败
+func (n GojaVMNet) recordSQLResult(err error) {
+    if err == ErrorStorageTimeout {
+        n.storageBackend().recordFailure()
+    } else if err != ErrorStorageUnavailable {
+        n.storageBackend().recordSuccess()
+    }
+}
+
+//redis调用失败时只返回nil, 以耗时达到超时时间判定为storage故障
+func (n GojaVMNet) recordStorageResult(ok bool, tb time.Time) {
+    if ok {
+        n.storageBackend().recordSuccess()
+    } else if time.Since(tb) >= n.storageTimeout() {
+        n.storageBackend().recordFailure()
+    }
+}
+
+//storage可能只配置了redis或mysql之一, 任一探测成功即视为可用
+func probeStorage(c *storage.Client) bool {
+    if c == nil {
+        return false
+    }
+    if c.RedisDo("PING") != nil {
+        return true
+    }
+    rows, err := c.DBQuery("SELECT 1")
+    return err == nil && rows != nil
+}
+
+func (b *StorageBackend) check() {
+    tb := time.Now()
+    ok := probeStorage(b.Client())
+
+    b.lock.Lock()
+    b.health.LastCheckMs = int64(time.Since(tb) / time.Millisecond)
+    b.health.LastCheckAt = nowMillis()
+    state := b.health.State
+    b.lock.Unlock()
+
+    if ok {
+        b.recordSuccess()
+        b.setState(StorageStateUp)
+        return
+    }
+
+    b.recordFailure()
+    if state == StorageStateUp {
+        return
+    }
+
+    //熔断期间重建tcp连接, 恢复前的一次探测为半开状态
+    if b.isTCP() || b.Client() == nil {
+        b.setState(StorageStateHalfOpen)
+        if b.connect() {
+            b.lock.Lock()
+            b.health.Reconnects++
+            b.lock.Unlock()
+            if probeStorage(b.Client()) {
+                b.recordSuccess()
+                b.setState(StorageStateUp)
+                return
+            }
+        }
+    }
+    b.setState(StorageStateDown)
+}
+
+func allStorageBackends() []*StorageBackend {
+    backends := []*StorageBackend{defaultStorage}
+    for _, b := range namedStorages {
+        backends = append(backends, b)
+    }
+    return backends
+}
+
+func startStorageHealth() {
+    if storageCheckInterval <= 0 {
+        return
+    }
+    storageHealthStopCh = make(chan int)
+    for _, b := range allStorageBackends() {
+        go func(b *StorageBackend) {
+            tr := time.NewTicker(storageCheckInterval)
+            defer tr.Stop()
+            for {
+                select {
+                case <-storageHealthStopCh:
+                    return
+                case <-tr.C:
+                    b.check()
+                }
+            }
+        }(b)
+    }
+}
+
+func stopStorageHealth() {
+    if storageHealthStopCh != nil {
+        close(storageHealthStopCh)
+    }
+}
+
+func (b *StorageBackend) Health() StorageHealth {
+    b.lock.RLock()
+    defer b.lock.RUnlock()
+    h := b.health
+    if !b.downAt.IsZero() {
+        h.DowntimeMs += int64(time.Since(b.downAt) / time.Millisecond)
+    }
+    return h
+}
+
+func storageHealthy() bool {
+    return defaultStorage.Health().State == StorageStateUp
+}
+
+func storageStates() map[string]string {
+    out := make(map[string]string)
+    for _, b := range allStorageBackends() {
+        out[b.Name] = b.Health().State
+    }
+    return out
+}
+
+func init() {
+    registerMetrics("storageHealth", func() interface{} {
+        out := make(map[string]StorageHealth)
+        for _, b := range allStorageBackends() {
+            out[b.Name] = b.Health()
+        }
+        return out
+    })
+    registerAdminCommand("storage", func(args interface{}) (interface{}, error) {
+        out := make(map[string]interface{})
+        for _, b := range allStorageBackends() {
+            out[b.Name] = map[string]interface{}{
+                "addr":    b.Addr,
+                "timeout": b.Timeout.String(),
+                "health":  b.Health(),
+            }
+        }
+        return out, nil
+    })
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+    "github.com/packing/clove/utils"
+    "github.com/packing/goja"
+)
+
+//旧脚本依赖失败时返回null/0, 开启后不抛出异常
+var storageLegacyErrors = false
+
+//脚本可用instanceof区分的错误类型, 均继承自Error
+var gojaErrorTypes = []string{
+    "StorageUnavailableError",
+    "SqlError",
+    "TimeoutError",
+}
+
+const gojaErrorTypeSource = `(function (name) {
+    var E = function (message) {
+        if (!(this instanceof E)) {
+            return new E(message);
+        }
+        this.message = message === undefined ? "" : String(message);
+        this.stack = (new Error(this.message)).stack;
+    };
+    E.prototype = Object.create(Error.prototype);
+    E.prototype.constructor = E;
+    E.prototype.name = name;
+    return E;
+})`
+
+func (vm *GojaVM) defineErrorTypes() {
+    v, err := vm.Runtime.RunString(gojaErrorTypeSource)
+    if err != nil {
+        return
+    }
+    factory, _ := goja.AssertFunction(v)
+    for _, name := range gojaErrorTypes {
+        ctor, err := factory(goja.Undefined(), vm.Runtime.ToValue(name))
+        if err == nil {
+            vm.Runtime.Set(name, ctor)
+        }
+    }
+}
+
+//按名称创建错误对象, 附加字段直接设置在对象上
+func (vm *GojaVM) newTypedError(name string, message string, fields map[string]interface{}) *goja.Object {
+    ctor := vm.Runtime.Get(name)
+    if ctor == nil {
+        return vm.Runtime.NewTypeError(message)
+    }
+    o, err := vm.Runtime.New(ctor, vm.Runtime.ToValue(message))
+    if err != nil {
+        return vm.Runtime.NewTypeError(message)
+    }
+    for k, v := range fields {
+        o.Set(k, v)
+    }
+    return o
+}
+
+//按失败原因抛出对应类型的错误: 熔断或未连接为StorageUnavailableError, 等待回复超时为TimeoutError,
+//storage返回的错误为SqlError, 带有mysql错误码code与错误信息sqlMessage
+func (n GojaVMNet) throwStorageError(op string, err error) {
+    name, message := "StorageUnavailableError", "storage is not available"
+    var fields map[string]interface{}
+    if e, ok := err.(*StorageSQLError); ok {
+        name, message = "SqlError", op+" failed: "+e.Error()
+        fields = map[string]interface{}{"code": e.Code, "sqlMessage": e.Message}
+    } else if err == ErrorStorageTimeout {
+        name, message = "TimeoutError", op+" timeout after "+n.storageTimeout().String()
+    }
+
+    stacks := make([]goja.StackFrame, 5)
+    errStr := GenGojaStackFrameString(n.vm, "[J] !!! "+name+": "+message, n.vm.Runtime.CaptureCallStack(5, stacks))
+    utils.LogError(errStr)
+    if storageLegacyErrors {
+        return
+    }
+    panic(n.vm.newTypedError(name, message, fields))
+}
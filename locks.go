@@ -0,0 +1,624 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "fmt"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/packing/clove/codecs"
+    "github.com/packing/clove/utils"
+    "github.com/packing/goja"
+)
+
+const (
+    LockStatusAcquired    = "acquired"
+    LockStatusTimeout     = "timeout"
+    LockStatusUnavailable = "unavailable"
+)
+
+//tryLock以极短的等待时间实现
+const lockTryWait = 10 * time.Millisecond
+
+//所有加锁方式都使用redis中会过期的锁记录, 持有进程崩溃后由redis在租期到达时删除;
+//未指定ttl时以lockWatchdogTTL为租期, 持有期间在进程内定期续期.
+//未指定timeout时最多等待lockMaxWait, 避免redis不可用时一直占用上下文
+const (
+    lockRetryInterval = 20 * time.Millisecond
+    lockWatchdogTTL   = 30 * time.Second
+    lockMaxWait       = 30 * time.Second
+
+    //锁记录的sid带有此标记, 以便与storage分配的sid区分; 保持在2^53以内, 脚本中以数字传递不会丢失精度
+    lockRecordSidFlag = int64(1) << 52
+
+    lockReleaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+    lockRenewScript   = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+)
+
+type lockLeaseKey struct {
+    key uint64
+    sid int64
+}
+
+//除key与sid外的字段由lockLeasesLock保护
+type lockLease struct {
+    key      uint64
+    sid      int64
+    ttl      time.Duration
+    watchdog bool
+    renewed  time.Time
+    timer    *time.Timer
+    held     *heldLock
+}
+
+//单个key的等待与持有统计
+type LockStat struct {
+    Acquired     uint64       `json:"acquired"`
+    Timeouts     uint64       `json:"timeouts"`
+    Unavailable  uint64       `json:"unavailable"`
+    AutoReleased uint64       `json:"autoReleased"`
+    Expired      uint64       `json:"expired"`
+    Wait         DurationStat `json:"wait"`
+    Hold         DurationStat `json:"hold"`
+}
+
+//默认锁键为会话ID, 限制按key统计的数量, 超出部分只计入汇总
+const lockStatsMaxKeys = 1024
+
+var (
+    lockLeasesLock sync.Mutex
+    lockLeases     = make(map[lockLeaseKey]*lockLease)
+
+    lockHoldWarn = time.Second
+
+    lockStatsLock  sync.Mutex
+    lockStats      = make(map[uint64]*LockStat)
+    lockStatsTotal LockStat
+
+    heldLocksLock sync.Mutex
+    heldLocksAll  = make(map[*heldLock]struct{})
+
+    lockMonitorStopCh chan int
+)
+
+func updateLockStat(key uint64, fn func(*LockStat)) {
+    lockStatsLock.Lock()
+    defer lockStatsLock.Unlock()
+    fn(&lockStatsTotal)
+    st, ok := lockStats[key]
+    if !ok {
+        if len(lockStats) >= lockStatsMaxKeys {
+            return
+        }
+        st = new(LockStat)
+        lockStats[key] = st
+    }
+    fn(st)
+}
+
+func lockRecordKey(key uint64) string {
+    return "__lock:" + strconv.FormatUint(namespaceLockKey(key), 10)
+}
+
+func isLockRecord(sid int64) bool {
+    return sid&lockRecordSidFlag != 0
+}
+
+//锁记录的sid随机生成, 多台slave之间不会冲突
+func newLockRecordSid() int64 {
+    var bs [8]byte
+    rand.Read(bs[:])
+    return int64(binary.BigEndian.Uint64(bs[:])&uint64(lockRecordSidFlag-1)) | lockRecordSidFlag
+}
+
+//timeout<=0时最多等待lockMaxWait
+func acquireLock(key uint64, timeout time.Duration, ttl time.Duration) (int64, string) {
+    tb := time.Now()
+    sid, status := acquireLockRecord(key, timeout, ttl)
+
+    switch status {
+    case LockStatusTimeout:
+        updateLockStat(key, func(st *LockStat) {
+            st.Timeouts++
+            st.Wait.Add(time.Since(tb))
+        })
+        return 0, status
+    case LockStatusUnavailable:
+        updateLockStat(key, func(st *LockStat) {
+            st.Unavailable++
+        })
+        return 0, status
+    }
+
+    updateLockStat(key, func(st *LockStat) {
+        st.Acquired++
+        st.Wait.Add(time.Since(tb))
+    })
+    atomic.AddUint64(&locklogic, 1)
+    return sid, LockStatusAcquired
+}
+
+//以SET NX PX写入锁记录, 已被占用时按间隔重试直到超时.
+//storage客户端在redis出错或超时时同样返回nil, SET未成功时以PTTL确认锁记录确实存在
+func acquireLockRecord(key uint64, timeout time.Duration, ttl time.Duration) (int64, string) {
+    lease := ttl
+    if lease <= 0 {
+        lease = lockWatchdogTTL
+    }
+    if timeout <= 0 || timeout > lockMaxWait {
+        timeout = lockMaxWait
+    }
+    sid := newLockRecordSid()
+    rk := lockRecordKey(key)
+    deadline := time.Now().Add(timeout)
+    for {
+        gs := storageClient()
+        if gs == nil {
+            return 0, LockStatusUnavailable
+        }
+        if gs.RedisDo("SET", rk, sid, "NX", "PX", int64(lease/time.Millisecond)) != nil {
+            startLockLease(key, sid, ttl)
+            return sid, LockStatusAcquired
+        }
+        pttl, ok := gs.RedisDo("PTTL", rk).(int64)
+        if !ok {
+            return 0, LockStatusUnavailable
+        }
+
+        left := time.Until(deadline)
+        if left <= 0 {
+            return 0, LockStatusTimeout
+        }
+        //-2表示锁记录已在两次命令之间被删除, 立即重试
+        if pttl == -2 {
+            continue
+        }
+        wait := lockRetryInterval
+        if left < wait {
+            wait = left
+        }
+        time.Sleep(wait)
+    }
+}
+
+func renewLockRecord(key uint64, sid int64, ttl time.Duration) bool {
+    gs := storageRawClient()
+    if gs == nil {
+        return false
+    }
+    return toRedisInt(gs.RedisDo("EVAL", lockRenewScript, 1, lockRecordKey(key), sid, int64(ttl/time.Millisecond))) == 1
+}
+
+func startLockLease(key uint64, sid int64, ttl time.Duration) {
+    l := &lockLease{key: key, sid: sid, ttl: ttl, watchdog: ttl <= 0, renewed: time.Now()}
+    d := ttl
+    if l.watchdog {
+        d = lockWatchdogTTL / 3
+    }
+    lockLeasesLock.Lock()
+    defer lockLeasesLock.Unlock()
+    lockLeases[lockLeaseKey{key: key, sid: sid}] = l
+    l.timer = time.AfterFunc(d, func() {
+        onLockLease(l)
+    })
+}
+
+//看门狗按租期的三分之一续期, 续期失败超过一个租期视为锁已丢失;
+//带ttl的租约到期时redis已删除锁记录, 同步移除分派中的持有记录
+func onLockLease(l *lockLease) {
+    lk := lockLeaseKey{key: l.key, sid: l.sid}
+    lockLeasesLock.Lock()
+    watchdog := l.watchdog
+    lockLeasesLock.Unlock()
+
+    if watchdog {
+        renewed := renewLockRecord(l.key, l.sid, lockWatchdogTTL)
+        lockLeasesLock.Lock()
+        if renewed {
+            l.renewed = time.Now()
+        }
+        //续期期间脚本可能已改为固定租期或释放了锁, 此时由对应的一方负责定时器
+        alive := !l.watchdog || time.Since(l.renewed) < lockWatchdogTTL
+        if alive && l.watchdog && lockLeases[lk] == l {
+            l.timer.Reset(lockWatchdogTTL / 3)
+        }
+        lockLeasesLock.Unlock()
+        if alive {
+            return
+        }
+    }
+
+    if stopLockLease(l.key, l.sid) == nil {
+        return
+    }
+    utils.LogWarn(">>> 锁 %d (sid %d) 租约已到期, 锁记录已由redis删除", l.key, l.sid)
+    updateLockStat(l.key, func(st *LockStat) {
+        st.Expired++
+    })
+    lockLeasesLock.Lock()
+    held := l.held
+    lockLeasesLock.Unlock()
+    if held != nil && held.vm.dropHeldLock(held) {
+        finishHeldLock(held, false)
+    }
+}
+
+func stopLockLease(key uint64, sid int64) *lockLease {
+    lk := lockLeaseKey{key: key, sid: sid}
+    lockLeasesLock.Lock()
+    defer lockLeasesLock.Unlock()
+    l, ok := lockLeases[lk]
+    if !ok {
+        return nil
+    }
+    l.timer.Stop()
+    delete(lockLeases, lk)
+    return l
+}
+
+//续期同时作用于redis中的锁记录与进程内的租约; 已到期的锁不能再续期
+func renewLockLease(key uint64, sid int64, ttl time.Duration) bool {
+    if !isLockRecord(sid) {
+        return false
+    }
+    lk := lockLeaseKey{key: key, sid: sid}
+    lockLeasesLock.Lock()
+    _, ok := lockLeases[lk]
+    lockLeasesLock.Unlock()
+    if !ok || !renewLockRecord(key, sid, ttl) {
+        return false
+    }
+
+    lockLeasesLock.Lock()
+    defer lockLeasesLock.Unlock()
+    l, ok := lockLeases[lk]
+    if !ok {
+        return false
+    }
+    l.ttl = ttl
+    l.watchdog = false
+    l.renewed = time.Now()
+    l.timer.Reset(ttl)
+    return true
+}
+
+func releaseLock(key uint64, sid int64) bool {
+    if !isLockRecord(sid) || stopLockLease(key, sid) == nil {
+        return false
+    }
+    gs := storageRawClient()
+    if gs == nil || toRedisInt(gs.RedisDo("EVAL", lockReleaseScript, 1, lockRecordKey(key), sid)) != 1 {
+        return false
+    }
+    atomic.AddUint64(&unlocklogic, 1)
+    return true
+}
+
+type heldLock struct {
+    vm       *GojaVM
+    key      uint64
+    sid      int64
+    session  uint64
+    acquired time.Time
+    stack    string
+    warned   int32
+}
+
+func (vm *GojaVM) trackLock(key uint64, sid int64) *heldLock {
+    stacks := make([]goja.StackFrame, 5)
+    held := &heldLock{
+        vm:       vm,
+        key:      key,
+        sid:      sid,
+        session:  vm.associatedSessionId,
+        acquired: time.Now(),
+        stack:    GenGojaStackFrameString(vm, "", vm.Runtime.CaptureCallStack(5, stacks)),
+    }
+    vm.heldLocksLock.Lock()
+    vm.heldLocks = append(vm.heldLocks, held)
+    vm.heldLocksLock.Unlock()
+
+    heldLocksLock.Lock()
+    heldLocksAll[held] = struct{}{}
+    heldLocksLock.Unlock()
+
+    lockLeasesLock.Lock()
+    if l, ok := lockLeases[lockLeaseKey{key: key, sid: sid}]; ok {
+        l.held = held
+    }
+    lockLeasesLock.Unlock()
+    return held
+}
+
+//租约到期时由定时器调用, 与脚本的unlock只有一方能移除持有记录
+func (vm *GojaVM) dropHeldLock(held *heldLock) bool {
+    vm.heldLocksLock.Lock()
+    defer vm.heldLocksLock.Unlock()
+    for i, h := range vm.heldLocks {
+        if h == held {
+            vm.heldLocks = append(vm.heldLocks[:i], vm.heldLocks[i+1:]...)
+            return true
+        }
+    }
+    return false
+}
+
+//记录持有时长, 自动释放或持有过久时输出获取锁时的脚本调用栈
+func finishHeldLock(held *heldLock, auto bool) {
+    heldLocksLock.Lock()
+    delete(heldLocksAll, held)
+    heldLocksLock.Unlock()
+
+    hold := time.Since(held.acquired)
+    updateLockStat(held.key, func(st *LockStat) {
+        st.Hold.Add(hold)
+        if auto {
+            st.AutoReleased++
+        }
+    })
+
+    if auto {
+        utils.LogWarn("[J] !!! 锁 %d (sid %d) 在分派结束时仍未归还, 已自动释放, 持有 %s. 获取位置:%s", held.key, held.sid, hold, held.stack)
+    } else if lockHoldWarn > 0 && hold > lockHoldWarn && atomic.CompareAndSwapInt32(&held.warned, 0, 1) {
+        utils.LogWarn("[J] !!! 锁 %d (sid %d) 持有时间过长 %s. 获取位置:%s", held.key, held.sid, hold, held.stack)
+    }
+}
+
+//分派卡住或锁未归还时finishHeldLock不会被调用, 由监视协程在持有期间输出告警, 每个锁只告警一次
+func checkHeldLocks(now time.Time) int {
+    if lockHoldWarn <= 0 {
+        return 0
+    }
+    heldLocksLock.Lock()
+    held := make([]*heldLock, 0, len(heldLocksAll))
+    for h := range heldLocksAll {
+        if now.Sub(h.acquired) > lockHoldWarn {
+            held = append(held, h)
+        }
+    }
+    heldLocksLock.Unlock()
+
+    warned := 0
+    for _, h := range held {
+        if atomic.CompareAndSwapInt32(&h.warned, 0, 1) {
+            utils.LogWarn("[J] !!! 锁 %d (sid %d, 会话 %d) 仍未归还, 已持有 %s. 获取位置:%s", h.key, h.sid, h.session, now.Sub(h.acquired), h.stack)
+            warned++
+        }
+    }
+    return warned
+}
+
+//检查间隔为告警阈值的一半, 限制在100ms到10s之间
+func startLockMonitor() {
+    if lockHoldWarn <= 0 {
+        return
+    }
+    interval := lockHoldWarn / 2
+    if interval < 100*time.Millisecond {
+        interval = 100 * time.Millisecond
+    } else if interval > 10*time.Second {
+        interval = 10 * time.Second
+    }
+    lockMonitorStopCh = make(chan int)
+    stopCh := lockMonitorStopCh
+    go func() {
+        t := time.NewTicker(interval)
+        defer t.Stop()
+        for {
+            select {
+            case <-stopCh:
+                return
+            case now := <-t.C:
+                checkHeldLocks(now)
+            }
+        }
+    }()
+}
+
+func stopLockMonitor() {
+    if lockMonitorStopCh != nil {
+        close(lockMonitorStopCh)
+        lockMonitorStopCh = nil
+    }
+}
+
+func (vm *GojaVM) untrackLock(key uint64, sid int64) bool {
+    vm.heldLocksLock.Lock()
+    var found *heldLock
+    for i, held := range vm.heldLocks {
+        if held.key == key && held.sid == sid {
+            vm.heldLocks = append(vm.heldLocks[:i], vm.heldLocks[i+1:]...)
+            found = held
+            break
+        }
+    }
+    vm.heldLocksLock.Unlock()
+    if found == nil {
+        return false
+    }
+    finishHeldLock(found, false)
+    return true
+}
+
+func (vm *GojaVM) findLock(key uint64) *heldLock {
+    vm.heldLocksLock.Lock()
+    defer vm.heldLocksLock.Unlock()
+    for i := len(vm.heldLocks) - 1; i >= 0; i-- {
+        if vm.heldLocks[i].key == key {
+            return vm.heldLocks[i]
+        }
+    }
+    return nil
+}
+
+//按获取的相反顺序释放本次分派中仍未归还的锁
+func (vm *GojaVM) releaseAllLocks() {
+    vm.heldLocksLock.Lock()
+    held := append([]*heldLock(nil), vm.heldLocks...)
+    vm.heldLocks = vm.heldLocks[:0]
+    vm.heldLocksLock.Unlock()
+
+    for i := len(held) - 1; i >= 0; i-- {
+        finishHeldLock(held[i], true)
+        releaseLock(held[i].key, held[i].sid)
+    }
+}
+
+func (n GojaVMNet) lockHandle(key uint64, sid int64, status string) goja.Value {
+    o := n.vm.Runtime.NewObject()
+    o.Set("status", status)
+    o.Set("ok", status == LockStatusAcquired)
+    o.Set("key", key)
+    o.Set("sid", sid)
+    o.Set("valueOf", func(call goja.FunctionCall) goja.Value {
+        return n.vm.Runtime.ToValue(sid)
+    })
+    o.Set("unlock", func(call goja.FunctionCall) goja.Value {
+        if status != LockStatusAcquired || !n.vm.untrackLock(key, sid) {
+            return n.vm.Runtime.ToValue(false)
+        }
+        return n.vm.Runtime.ToValue(releaseLock(key, sid))
+    })
+    o.Set("renew", func(call goja.FunctionCall) goja.Value {
+        if len(call.Arguments) == 0 || status != LockStatusAcquired {
+            return n.vm.Runtime.ToValue(false)
+        }
+        ttl := time.Duration(call.Arguments[0].ToInteger()) * time.Millisecond
+        if ttl <= 0 {
+            return n.vm.Runtime.ToValue(false)
+        }
+        return n.vm.Runtime.ToValue(renewLockLease(key, sid, ttl))
+    })
+    return o
+}
+
+func (n GojaVMNet) lockOptions(call goja.FunctionCall, idx int) (time.Duration, time.Duration) {
+    var timeout, ttl time.Duration
+    if len(call.Arguments) > idx && !goja.IsUndefined(call.Arguments[idx]) && !goja.IsNull(call.Arguments[idx]) {
+        opts := call.Arguments[idx].ToObject(n.vm.Runtime)
+        if v := opts.Get("timeout"); v != nil && !goja.IsUndefined(v) && !goja.IsNull(v) {
+            timeout = time.Duration(v.ToInteger()) * time.Millisecond
+        }
+        if v := opts.Get("ttl"); v != nil && !goja.IsUndefined(v) && !goja.IsNull(v) {
+            ttl = time.Duration(v.ToInteger()) * time.Millisecond
+        }
+    }
+    return timeout, ttl
+}
+
+func (n GojaVMNet) TryLock(call goja.FunctionCall) goja.Value {
+    key := n.vm.defKeyForLock
+    if len(call.Arguments) > 0 && !goja.IsUndefined(call.Arguments[0]) && !goja.IsNull(call.Arguments[0]) {
+        key = uint64(call.Arguments[0].ToInteger())
+    }
+    _, ttl := n.lockOptions(call, 1)
+
+    tb := time.Now()
+    sid, status := acquireLock(key, lockTryWait, ttl)
+    n.observeStorage("lock", "sync.tryLock", []interface{}{key}, tb)
+    if status == LockStatusAcquired {
+        n.vm.trackLock(key, sid)
+    }
+    return n.lockHandle(key, sid, status)
+}
+
+func (n GojaVMNet) RenewLock(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) < 3 {
+        return n.vm.Runtime.ToValue(false)
+    }
+    key := uint64(call.Arguments[0].ToInteger())
+    sid := call.Arguments[1].ToInteger()
+    ttl := time.Duration(call.Arguments[2].ToInteger()) * time.Millisecond
+    if ttl <= 0 {
+        return n.vm.Runtime.ToValue(false)
+    }
+    return n.vm.Runtime.ToValue(renewLockLease(key, sid, ttl))
+}
+
+//sync.withLock(keys, fn, opts) 按键值升序加锁以避免死锁, 无论fn是否抛出异常都会全部释放
+func (n GojaVMNet) WithLock(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) < 2 {
+        panic(n.vm.Runtime.NewTypeError("sync.withLock requires keys and function"))
+    }
+    fn, ok := goja.AssertFunction(call.Arguments[1])
+    if !ok {
+        panic(n.vm.Runtime.NewTypeError("sync.withLock requires a function"))
+    }
+
+    keys := make([]uint64, 0)
+    if arr, ok := call.Arguments[0].Export().([]interface{}); ok {
+        for _, k := range arr {
+            keys = append(keys, uint64(codecs.Int64FromInterface(k)))
+        }
+    } else {
+        keys = append(keys, uint64(call.Arguments[0].ToInteger()))
+    }
+    sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+    timeout, ttl := n.lockOptions(call, 2)
+
+    acquired := make([]*heldLock, 0, len(keys))
+    defer func() {
+        for i := len(acquired) - 1; i >= 0; i-- {
+            if n.vm.untrackLock(acquired[i].key, acquired[i].sid) {
+                releaseLock(acquired[i].key, acquired[i].sid)
+            }
+        }
+    }()
+
+    for i, key := range keys {
+        if i > 0 && key == keys[i-1] {
+            continue
+        }
+        tb := time.Now()
+        sid, status := acquireLock(key, timeout, ttl)
+        n.observeStorage("lock", "sync.withLock", []interface{}{key}, tb)
+        if status != LockStatusAcquired {
+            e := n.vm.Runtime.NewGoError(fmt.Errorf("lock %d %s", key, status))
+            e.Set("status", status)
+            panic(e)
+        }
+        acquired = append(acquired, n.vm.trackLock(key, sid))
+    }
+
+    r, err := fn(goja.Undefined())
+    if err != nil {
+        panic(err)
+    }
+    return r
+}
+
+func init() {
+    registerMetrics("locks", func() interface{} {
+        lockStatsLock.Lock()
+        defer lockStatsLock.Unlock()
+        keys := make(map[string]LockStat, len(lockStats))
+        for key, st := range lockStats {
+            keys[strconv.FormatUint(key, 10)] = *st
+        }
+        return map[string]interface{}{
+            "total": lockStatsTotal,
+            "keys":  keys,
+        }
+    })
+    registerAdminCommand("locks", func(args interface{}) (interface{}, error) {
+        heldLocksLock.Lock()
+        defer heldLocksLock.Unlock()
+        out := make([]map[string]interface{}, 0, len(heldLocksAll))
+        for held := range heldLocksAll {
+            out = append(out, map[string]interface{}{
+                "key":     held.key,
+                "sid":     held.sid,
+                "session": held.session,
+                "heldMs":  int64(time.Since(held.acquired) / time.Millisecond),
+                "stack":   held.stack,
+            })
+        }
+        sort.Slice(out, func(i, j int) bool { return out[i]["heldMs"].(int64) > out[j]["heldMs"].(int64) })
+        return out, nil
+    })
+}
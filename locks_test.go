@@ -0,0 +1,67 @@
+package main
+
+import (
+    "testing"
+    "time"
+
+    "github.com/packing/goja"
+)
+
+func TestLeaseExpiry(t *testing.T) {
+    vm := &GojaVM{Runtime: goja.New()}
+    sid := newLockRecordSid()
+    if !isLockRecord(sid) || sid >= 1<<53 {
+        t.Fatal(sid)
+    }
+    startLockLease(7, sid, 20*time.Millisecond)
+    vm.trackLock(7, sid)
+    time.Sleep(60 * time.Millisecond)
+    if vm.findLock(7) != nil || stopLockLease(7, sid) != nil {
+        t.Fatal("not dropped")
+    }
+    if releaseLock(7, sid) {
+        t.Fatal("released expired")
+    }
+}
+
+func TestLeaseExpiryRacesUnlock(t *testing.T) {
+    vm := &GojaVM{Runtime: goja.New()}
+    for i := 0; i < 50; i++ {
+        sid := newLockRecordSid()
+        startLockLease(8, sid, time.Millisecond)
+        vm.trackLock(8, sid)
+        time.Sleep(time.Millisecond)
+        vm.untrackLock(8, sid)
+        releaseLock(8, sid)
+    }
+    time.Sleep(10 * time.Millisecond)
+    if vm.findLock(8) != nil {
+        t.Fatal("held lock left behind")
+    }
+}
+
+func TestAcquireLockWithoutStorage(t *testing.T) {
+    for _, c := range []struct{ timeout, ttl time.Duration }{{0, 0}, {time.Second, 0}, {0, time.Second}} {
+        if sid, status := acquireLock(9, c.timeout, c.ttl); sid != 0 || status != LockStatusUnavailable {
+            t.Errorf("timeout %s ttl %s: got %d %s", c.timeout, c.ttl, sid, status)
+        }
+    }
+}
+
+func TestCheckHeldLocks(t *testing.T) {
+    vm := &GojaVM{Runtime: goja.New()}
+    held := vm.trackLock(10, newLockRecordSid())
+    defer vm.untrackLock(held.key, held.sid)
+
+    now := held.acquired.Add(lockHoldWarn / 2)
+    if n := checkHeldLocks(now); n != 0 {
+        t.Fatalf("warned %d before threshold", n)
+    }
+    now = held.acquired.Add(lockHoldWarn + time.Millisecond)
+    if n := checkHeldLocks(now); n != 1 {
+        t.Fatalf("warned %d while held past threshold", n)
+    }
+    if n := checkHeldLocks(now.Add(time.Minute)); n != 0 {
+        t.Fatalf("warned %d again", n)
+    }
+}
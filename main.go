@@ -16,7 +16,6 @@ import (
     "github.com/packing/clove/messages"
     "github.com/packing/clove/nnet"
     "github.com/packing/clove/packets"
-    "github.com/packing/clove/storage"
     "github.com/packing/clove/utils"
 
     //"github.com/packing/v8go"
@@ -44,6 +43,8 @@ var (
     unixAddr    string
     addrStorage string
 
+    storageTimeout = time.Second * 5
+
     pprofFile string
 
     logDir   string
@@ -52,19 +53,24 @@ var (
 
     sckDir = "./app.js"
 
+    httpHosts = ""
+
     cpuNum = 0
 
     scriptEngine = ScriptEngineGoja
 
     unix            *nnet.UnixUDP = nil
     tcpCtrl         *nnet.TCPClient = nil
-    globalStorage   *storage.Client = nil
 )
 
 func usage() {
     fmt.Fprint(os.Stderr, `slave
 
-Usage: slave [-hv] [-d daemon] [-f pprof file] [-c master addr] [-m vm limit] [-e script entryfile]
+Usage: slave [-hvdtq] [-f pprof file] [-c master addr] [-b storage addr] [-m vm limit] [-e script entryfile]
+             [-w http hosts] [-o http timeout] [-a admin addr] [-k admin token] [-u admin audit file]
+             [-l slow threshold] [-x slow log args] [-y query cache bytes] [-p storage backends]
+             [-j storage check interval] [-n storage namespace] [-s redis scripts dir]
+             [-r pubsub addr] [-g lock hold warn] [-i tick interval]
 
 Options:
 `)
@@ -84,7 +90,13 @@ func sayHello() error {
     if !onlyTCP {
         req[messages.ProtocolKeyUnixAddr] = unixAddr
     }
-    req[messages.ProtocolKeyValue] = getVMFree()
+    //默认storage不可用时不再接收新的会话
+    if storageHealthy() {
+        req[messages.ProtocolKeyValue] = getVMFree()
+    } else {
+        req[messages.ProtocolKeyValue] = 0
+    }
+    req["storage"] = storageStates()
     msg.SetBody(req)
     pck, err := messages.DataFromMessage(msg)
     if err == nil {
@@ -100,7 +112,13 @@ func reportState() error {
     msg := messages.CreateS2SMessage(messages.ProtocolTypeSlaveChange)
     msg.SetTag(messages.ProtocolTagMaster)
     req := codecs.IMMap{}
-    req[messages.ProtocolKeyValue] = getVMFree()
+    //默认storage不可用时不再接收新的会话
+    if storageHealthy() {
+        req[messages.ProtocolKeyValue] = getVMFree()
+    } else {
+        req[messages.ProtocolKeyValue] = 0
+    }
+    req["storage"] = storageStates()
     msg.SetBody(req)
     pck, err := messages.DataFromMessage(msg)
     if err == nil {
@@ -170,6 +188,22 @@ func main() {
     flag.StringVar(&addrStorage, "b", "/tmp/storage.sock", "storage addr")
     flag.IntVar(&cpuNum, "m", 100, "cpu limit")
     flag.StringVar(&sckDir, "e", sckDir, "script entryfile")
+    flag.StringVar(&httpHosts, "w", httpHosts, "http allow hosts, comma separated")
+    flag.DurationVar(&httpMaxTimeout, "o", httpMaxTimeout, "http timeout limit")
+    flag.StringVar(&adminAddr, "a", adminAddr, "admin addr (unix socket path or localhost:port)")
+    flag.StringVar(&adminToken, "k", adminToken, "admin token (required by -a)")
+    flag.StringVar(&adminAudit, "u", adminAudit, "admin audit log file")
+    flag.DurationVar(&slowLogThreshold, "l", slowLogThreshold, "slow storage call threshold, 0 to disable")
+    flag.StringVar(&slowLogArgs, "x", slowLogArgs, "slow log arguments: redact, type or show")
+    flag.IntVar(&queryCacheMaxBytes, "y", queryCacheMaxBytes, "mysql query cache size in bytes, 0 to disable")
+    flag.BoolVar(&storageLegacyErrors, "q", storageLegacyErrors, "return null/0 on storage failures instead of throwing")
+    flag.StringVar(&storageBackends, "p", storageBackends, "named storage backends (name=addr[;timeout=2s][;buffer=bytes],...)")
+    flag.DurationVar(&storageCheckInterval, "j", storageCheckInterval, "storage health check interval, 0 to disable")
+    flag.StringVar(&storageNamespace, "n", storageNamespace, "storage namespace prefixed to redis keys, pubsub channels and lock keys")
+    flag.StringVar(&redisScriptsDir, "s", redisScriptsDir, "redis lua scripts dir")
+    flag.StringVar(&addrPubSub, "r", addrPubSub, "redis addr for pubsub ([password@]host:port)")
+    flag.DurationVar(&lockHoldWarn, "g", lockHoldWarn, "lock hold warning threshold, 0 to disable")
+    flag.DurationVar(&tickInterval, "i", tickInterval, "__tick__ interval, 0 to disable")
     flag.Usage = usage
 
     flag.Parse()
@@ -242,7 +276,14 @@ func main() {
         }
     }
 
-    globalStorage = storage.CreateClientWithBufferSize(addrStorage, time.Second * 5, 5242880, 5242880)
+    if createDefaultStorage(addrStorage, storageTimeout) == nil {
+        utils.LogError("!!!无法连接到storage %s", addrStorage)
+    }
+    err = createStorageBackends(storageBackends)
+    if err != nil {
+        utils.LogError("!!!无法创建storage后端 %s", err)
+        return
+    }
 
     if scriptEngine == ScriptEngineV8 {
         /*utils.LogInfo("==============================================================")
@@ -260,6 +301,10 @@ func main() {
 
     } else if scriptEngine == ScriptEngineGoja {
         GojaInit()
+        setHttpAllowHosts(httpHosts)
+        if err := loadRedisScripts(redisScriptsDir); err != nil {
+            utils.LogError("!!!无法加载redis脚本 %s %s", redisScriptsDir, err)
+        }
 
         OnGojaSendMessage = sendMessage
         OnGojaSendMessageTo = sendMessageTo
@@ -329,18 +374,31 @@ func main() {
 
     go purgeVM()
 
+    startTicker()
+    startPubSub()
+    startLockMonitor()
+    startStorageHealth()
+
+    err = startAdmin()
+    if err != nil {
+        utils.LogError("!!!无法启动管理接口 %s %s", adminAddr, err.Error())
+    }
+
     utils.LogInfo(">>> 当前协程数量 > %d", runtime.NumGoroutine())
     env.Schedule()
 
+    stopAdmin()
+    stopTicker()
+    stopPubSub()
+    stopLockMonitor()
     disposeQueue()
 
     if scriptEngine == ScriptEngineV8 {
         //v8go.Dispose()
     }
 
-    if globalStorage != nil {
-        globalStorage.Close()
-    }
+    stopStorageHealth()
+    closeStorageBackends()
     tcpCtrl.Close()
     unix.Close()
 }
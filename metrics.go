@@ -0,0 +1,66 @@
+package main
+
+import (
+    "runtime"
+    "sync"
+    "time"
+)
+
+type MetricsFunc func() interface{}
+
+var (
+    metricsLock      sync.Mutex
+    metricsProviders = make(map[string]MetricsFunc)
+)
+
+//各模块在init中注册自己的统计项, 由管理接口的metrics指令统一输出
+func registerMetrics(name string, fn MetricsFunc) {
+    metricsLock.Lock()
+    defer metricsLock.Unlock()
+    metricsProviders[name] = fn
+}
+
+func collectMetrics() map[string]interface{} {
+    metricsLock.Lock()
+    providers := make(map[string]MetricsFunc, len(metricsProviders))
+    for name, fn := range metricsProviders {
+        providers[name] = fn
+    }
+    metricsLock.Unlock()
+
+    out := make(map[string]interface{})
+    for name, fn := range providers {
+        out[name] = fn()
+    }
+    return out
+}
+
+//耗时统计, 单位为微秒
+type DurationStat struct {
+    Count uint64 `json:"count"`
+    Total int64  `json:"totalUs"`
+    Max   int64  `json:"maxUs"`
+}
+
+func (s *DurationStat) Add(d time.Duration) {
+    us := int64(d / time.Microsecond)
+    s.Count++
+    s.Total += us
+    if us > s.Max {
+        s.Max = us
+    }
+}
+
+func init() {
+    registerMetrics("process", func() interface{} {
+        return map[string]interface{}{
+            "goroutines": runtime.NumGoroutine(),
+            "vmTotal":    cpuNum,
+            "vmFree":     getVMFree(),
+            "sessions":   sessionCount(),
+        }
+    })
+    registerAdminCommand("metrics", func(args interface{}) (interface{}, error) {
+        return collectMetrics(), nil
+    })
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "github.com/packing/goja"
+)
+
+const mysqlTimeLayout = "2006-01-02 15:04:05.000"
+
+//将:name占位符替换为?, 并按出现顺序从对象中取值; 字符串字面量和注释中的冒号不处理
+func bindNamedParams(sql string, params map[string]interface{}) (string, []interface{}, error) {
+    var b strings.Builder
+    args := make([]interface{}, 0)
+    var quote byte
+    for i := 0; i < len(sql); i++ {
+        c := sql[i]
+        if quote != 0 {
+            b.WriteByte(c)
+            if c == '\\' && quote != '`' && i+1 < len(sql) {
+                i++
+                b.WriteByte(sql[i])
+            } else if c == quote {
+                quote = 0
+            }
+            continue
+        }
+        switch {
+        case c == '\'' || c == '"' || c == '`':
+            quote = c
+            b.WriteByte(c)
+        case c == '-' && i+1 < len(sql) && sql[i+1] == '-', c == '#':
+            end := strings.IndexByte(sql[i:], '\n')
+            if end < 0 {
+                end = len(sql) - i
+            }
+            b.WriteString(sql[i : i+end])
+            i += end - 1
+        case c == ':' && i+1 < len(sql) && isIdentStart(sql[i+1]) && (i == 0 || sql[i-1] != ':'):
+            j := i + 1
+            for j < len(sql) && isIdentPart(sql[j]) {
+                j++
+            }
+            name := sql[i+1 : j]
+            v, ok := params[name]
+            if !ok {
+                return "", nil, fmt.Errorf("missing sql parameter :%s", name)
+            }
+            args = append(args, v)
+            b.WriteByte('?')
+            i = j - 1
+        default:
+            b.WriteByte(c)
+        }
+    }
+    return b.String(), args, nil
+}
+
+func isIdentStart(c byte) bool {
+    return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+    return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func isBinaryObject(obj *goja.Object) bool {
+    if _, ok := obj.Export().(goja.ArrayBuffer); ok {
+        return true
+    }
+    if buf := obj.Get("buffer"); buf != nil {
+        _, ok := buf.Export().(goja.ArrayBuffer)
+        return ok
+    }
+    return false
+}
+
+func isPlainObject(v goja.Value) bool {
+    obj, ok := v.(*goja.Object)
+    if !ok {
+        return false
+    }
+    return obj.ClassName() == "Object" && !isBinaryObject(obj)
+}
+
+//Date按本地时间格式化, 二进制数据以[]byte传给storage
+func (n GojaVMNet) mysqlArg(v goja.Value) interface{} {
+    if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+        return nil
+    }
+    obj, ok := v.(*goja.Object)
+    if !ok {
+        return v.Export()
+    }
+    if obj.ClassName() == "Date" {
+        if t, ok := obj.Export().(time.Time); ok {
+            return t.Local().Format(mysqlTimeLayout)
+        }
+    }
+    if isBinaryObject(obj) {
+        return gojaValueToBytes(v)
+    }
+    return obj.Export()
+}
+
+//mysql.query(sql, {name: v}, opts) / mysql.query(sql, [v1, v2], opts) / mysql.query(sql, v1, v2, ..., opts)
+func (n GojaVMNet) mysqlStatement(call goja.FunctionCall) (string, []interface{}, *goja.Object) {
+    sql := call.Arguments[0].String()
+    rest := call.Arguments[1:]
+    var opts *goja.Object
+    if len(rest) > 0 {
+        if o, ok := call.Argument(2).(*goja.Object); ok && isPlainObject(o) {
+            opts = o
+        }
+    }
+
+    if len(rest) > 0 && isPlainObject(rest[0]) {
+        obj := rest[0].(*goja.Object)
+        params := make(map[string]interface{})
+        for _, k := range obj.Keys() {
+            params[k] = n.mysqlArg(obj.Get(k))
+        }
+        s, args, err := bindNamedParams(sql, params)
+        if err != nil {
+            panic(n.vm.Runtime.NewTypeError(err.Error()))
+        }
+        return s, args, opts
+    }
+
+    if len(rest) > 0 {
+        if obj, ok := rest[0].(*goja.Object); ok && obj.ClassName() == "Array" {
+            var list []goja.Value
+            n.vm.Runtime.ExportTo(obj, &list)
+            args := make([]interface{}, 0, len(list))
+            for _, a := range list {
+                args = append(args, n.mysqlArg(a))
+            }
+            return sql, args, opts
+        }
+    }
+
+    //逐个传参时, 最后一个参数为只含cache/tags/types的普通对象时视为opts
+    if len(rest) > 1 && isMysqlOptions(rest[len(rest)-1]) {
+        opts = rest[len(rest)-1].(*goja.Object)
+        rest = rest[:len(rest)-1]
+    } else {
+        opts = nil
+    }
+    args := make([]interface{}, 0, len(rest))
+    for _, a := range rest {
+        args = append(args, n.mysqlArg(a))
+    }
+    return sql, args, opts
+}
+
+var mysqlOptionKeys = map[string]bool{"cache": true, "tags": true, "types": true}
+
+func isMysqlOptions(v goja.Value) bool {
+    if !isPlainObject(v) {
+        return false
+    }
+    keys := v.(*goja.Object).Keys()
+    for _, k := range keys {
+        if !mysqlOptionKeys[k] {
+            return false
+        }
+    }
+    return len(keys) > 0
+}
+
+//storage不携带列类型, 按值本身的Go类型转换, 可用opts.types按列名指定number/string/date/blob/bool
+func (n GojaVMNet) mysqlValue(v interface{}, hint string) goja.Value {
+    switch hint {
+    case "number":
+        switch s := v.(type) {
+        case []byte:
+            return n.vm.Runtime.ToValue(string(s)).ToNumber()
+        case string:
+            return n.vm.Runtime.ToValue(s).ToNumber()
+        }
+    case "string":
+        switch s := v.(type) {
+        case []byte:
+            return n.vm.Runtime.ToValue(string(s))
+        case nil:
+        default:
+            return n.vm.Runtime.ToValue(fmt.Sprint(s))
+        }
+    case "blob":
+        switch s := v.(type) {
+        case []byte:
+            return gojaBytesValue(n.vm, s)
+        case string:
+            return gojaBytesValue(n.vm, []byte(s))
+        }
+    case "bool":
+        switch s := v.(type) {
+        case []byte:
+            return n.vm.Runtime.ToValue(string(s) != "0" && len(s) > 0)
+        case string:
+            return n.vm.Runtime.ToValue(s != "0" && len(s) > 0)
+        case int64:
+            return n.vm.Runtime.ToValue(s != 0)
+        }
+    case "date":
+        var s string
+        switch t := v.(type) {
+        case []byte:
+            s = string(t)
+        case string:
+            s = t
+        case time.Time:
+            return n.dateValue(t)
+        }
+        for _, layout := range []string{mysqlTimeLayout, "2006-01-02 15:04:05", "2006-01-02"} {
+            if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+                return n.dateValue(t)
+            }
+        }
+    }
+
+    switch s := v.(type) {
+    case nil:
+        return goja.Null()
+    case []byte:
+        if utf8.Valid(s) {
+            return n.vm.Runtime.ToValue(string(s))
+        }
+        return gojaBytesValue(n.vm, s)
+    case time.Time:
+        return n.dateValue(s)
+    }
+    return n.vm.Runtime.ToValue(v)
+}
+
+func (n GojaVMNet) dateValue(t time.Time) goja.Value {
+    d, err := n.vm.Runtime.New(n.vm.Runtime.Get("Date"), n.vm.Runtime.ToValue(t.UnixNano()/int64(time.Millisecond)))
+    if err != nil {
+        return n.vm.Runtime.ToValue(t.Format(mysqlTimeLayout))
+    }
+    return d
+}
+
+func (n GojaVMNet) mysqlRows(rows []interface{}, opts *goja.Object) goja.Value {
+    hints := make(map[string]string)
+    if opts != nil {
+        if t, ok := opts.Get("types").(*goja.Object); ok {
+            for _, k := range t.Keys() {
+                hints[k] = t.Get(k).String()
+            }
+        }
+    }
+
+    out := make([]interface{}, len(rows))
+    for i, row := range rows {
+        switch r := row.(type) {
+        case map[interface{}]interface{}:
+            o := n.vm.Runtime.NewObject()
+            for k, v := range r {
+                col := fmt.Sprint(k)
+                if bs, ok := k.([]byte); ok {
+                    col = string(bs)
+                }
+                o.Set(col, n.mysqlValue(v, hints[col]))
+            }
+            out[i] = o
+        case []interface{}:
+            cols := make([]interface{}, len(r))
+            for j, v := range r {
+                cols[j] = n.mysqlValue(v, "")
+            }
+            out[i] = cols
+        default:
+            out[i] = n.mysqlValue(r, "")
+        }
+    }
+    return n.vm.Runtime.ToValue(out)
+}
+
+//{affectedRows, insertId}; valueOf保持与旧版返回数字时的比较写法兼容.
+//storage端的语句在连接池中执行, 另行查询LAST_INSERT_ID()不能保证在同一连接上, 只能由storage在exec回复中带回;
+//storage未带回时insertId为null
+func (n GojaVMNet) execResult(res sqlExecResult) goja.Value {
+    o := n.vm.Runtime.NewObject()
+    o.Set("affectedRows", res.affected)
+    if res.hasInsertId {
+        o.Set("insertId", res.insertId)
+    } else {
+        o.Set("insertId", goja.Null())
+    }
+    o.Set("valueOf", func(call goja.FunctionCall) goja.Value {
+        return n.vm.Runtime.ToValue(res.affected)
+    })
+    return o
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "hash/fnv"
+    "strings"
+)
+
+//多个环境共用同一个storage时, 用命名空间隔离redis键、订阅频道与锁键
+var storageNamespace = ""
+
+//redis参数中键的位置, 从命令后的第一个参数开始计1; last为-1表示直到末尾, -2表示末尾参数之前
+type redisKeySpec struct {
+    first int
+    last  int
+    step  int
+}
+
+var redisKeySpecs = map[string]redisKeySpec{}
+
+func init() {
+    single := []string{
+        "get", "set", "setnx", "setex", "psetex", "getset", "getdel", "getex", "append", "strlen",
+        "incr", "decr", "incrby", "decrby", "incrbyfloat", "getrange", "setrange", "getbit", "setbit", "bitcount", "bitpos",
+        "expire", "pexpire", "expireat", "pexpireat", "ttl", "pttl", "persist", "type", "dump", "restore",
+        "hget", "hset", "hsetnx", "hmset", "hmget", "hgetall", "hdel", "hlen", "hexists", "hincrby", "hincrbyfloat",
+        "hkeys", "hvals", "hscan", "hstrlen",
+        "lpush", "rpush", "lpushx", "rpushx", "lpop", "rpop", "llen", "lrange", "lindex", "lset", "lrem", "ltrim", "linsert",
+        "sadd", "srem", "smembers", "sismember", "scard", "spop", "srandmember", "sscan",
+        "zadd", "zrem", "zscore", "zincrby", "zcard", "zcount", "zrange", "zrevrange", "zrangebyscore", "zrevrangebyscore",
+        "zrank", "zrevrank", "zremrangebyrank", "zremrangebyscore", "zremrangebylex", "zscan", "zlexcount", "zrangebylex",
+        "zrevrangebylex", "pfadd", "geoadd", "geopos", "geodist", "geohash", "georadius", "georadiusbymember",
+    }
+    for _, c := range single {
+        redisKeySpecs[c] = redisKeySpec{1, 1, 1}
+    }
+    multi := []string{
+        "del", "unlink", "exists", "touch", "mget", "watch", "sinter", "sunion", "sdiff",
+        "sinterstore", "sunionstore", "sdiffstore", "pfcount", "pfmerge",
+    }
+    for _, c := range multi {
+        redisKeySpecs[c] = redisKeySpec{1, -1, 1}
+    }
+    redisKeySpecs["mset"] = redisKeySpec{1, -1, 2}
+    redisKeySpecs["msetnx"] = redisKeySpec{1, -1, 2}
+    redisKeySpecs["rename"] = redisKeySpec{1, 2, 1}
+    redisKeySpecs["renamenx"] = redisKeySpec{1, 2, 1}
+    redisKeySpecs["rpoplpush"] = redisKeySpec{1, 2, 1}
+    redisKeySpecs["brpoplpush"] = redisKeySpec{1, 2, 1}
+    redisKeySpecs["smove"] = redisKeySpec{1, 2, 1}
+    redisKeySpecs["blpop"] = redisKeySpec{1, -2, 1}
+    redisKeySpecs["brpop"] = redisKeySpec{1, -2, 1}
+    redisKeySpecs["bitop"] = redisKeySpec{2, -1, 1}
+    //频道与键共用同一个前缀
+    redisKeySpecs["publish"] = redisKeySpec{1, 1, 1}
+}
+
+//命名空间中的通配字符需要转义, 否则会匹配到其他命名空间的键
+func namespacePattern(v interface{}) interface{} {
+    var b strings.Builder
+    for _, r := range storageNamespace {
+        if strings.ContainsRune(`*?[]\`, r) {
+            b.WriteByte('\\')
+        }
+        b.WriteRune(r)
+    }
+    return b.String() + redisArgString(v)
+}
+
+func namespaceChannel(channel string) string {
+    return storageNamespace + channel
+}
+
+//收到的频道名去掉命名空间前缀后交给脚本
+func stripNamespace(name string) string {
+    return strings.TrimPrefix(name, storageNamespace)
+}
+
+func prefixRedisKey(v interface{}) interface{} {
+    switch k := v.(type) {
+    case string:
+        return storageNamespace + k
+    case []byte:
+        return append([]byte(storageNamespace), k...)
+    }
+    return storageNamespace + fmt.Sprint(v)
+}
+
+func redisNumKeys(v interface{}) int {
+    var n int
+    switch k := v.(type) {
+    case string:
+        fmt.Sscan(k, &n)
+    case []byte:
+        fmt.Sscan(string(k), &n)
+    default:
+        fmt.Sscan(fmt.Sprint(v), &n)
+    }
+    return n
+}
+
+//按命令的键位置给键加上命名空间前缀, 无法识别的命令原样发送.
+//KEYS的模式与SCAN的MATCH模式同样加前缀, SCAN未指定MATCH时补上, 只列出本命名空间的键
+func namespaceRedisArgs(cmd string, args []interface{}) []interface{} {
+    c := strings.ToLower(cmd)
+    if storageNamespace == "" || (len(args) == 0 && c != "keys") {
+        return args
+    }
+    out := make([]interface{}, len(args))
+    copy(out, args)
+
+    switch c {
+    case "keys":
+        if len(out) == 0 {
+            return []interface{}{namespacePattern("*")}
+        }
+        out[0] = namespacePattern(out[0])
+        return out
+    case "scan":
+        //cursor [MATCH pattern] [COUNT count] [TYPE type]
+        for i := 1; i+1 < len(out); i += 2 {
+            if strings.EqualFold(redisArgString(out[i]), "match") {
+                out[i+1] = namespacePattern(out[i+1])
+                return out
+            }
+        }
+        return append(out, "MATCH", namespacePattern("*"))
+    case "eval", "evalsha":
+        //script numkeys key [key ...] arg [arg ...]
+        if len(out) > 1 {
+            n := redisNumKeys(out[1])
+            for i := 2; i < 2+n && i < len(out); i++ {
+                out[i] = prefixRedisKey(out[i])
+            }
+        }
+        return out
+    case "zunionstore", "zinterstore":
+        //destination numkeys key [key ...] ...
+        out[0] = prefixRedisKey(out[0])
+        if len(out) > 1 {
+            n := redisNumKeys(out[1])
+            for i := 2; i < 2+n && i < len(out); i++ {
+                out[i] = prefixRedisKey(out[i])
+            }
+        }
+        return out
+    }
+
+    spec, ok := redisKeySpecs[c]
+    if !ok {
+        return out
+    }
+    last := spec.last
+    if last < 0 {
+        last = len(out) + last + 1
+    }
+    for i := spec.first; i <= last && i <= len(out); i += spec.step {
+        out[i-1] = prefixRedisKey(out[i-1])
+    }
+    return out
+}
+
+//KEYS与SCAN返回的键名去掉命名空间前缀, 脚本可以直接用于后续命令.
+//send与receive分开调用时回复无法对应到命令, 返回的键名保留前缀
+func unnamespaceRedisReply(cmd string, reply interface{}) interface{} {
+    if storageNamespace == "" {
+        return reply
+    }
+    switch strings.ToLower(cmd) {
+    case "keys":
+        return stripNamespaceKeys(reply)
+    case "scan":
+        if arr, ok := reply.([]interface{}); ok && len(arr) == 2 {
+            return []interface{}{arr[0], stripNamespaceKeys(arr[1])}
+        }
+    }
+    return reply
+}
+
+func stripNamespaceKeys(v interface{}) interface{} {
+    arr, ok := v.([]interface{})
+    if !ok {
+        return v
+    }
+    out := make([]interface{}, len(arr))
+    for i, k := range arr {
+        switch s := k.(type) {
+        case []byte:
+            out[i] = []byte(stripNamespace(string(s)))
+        case string:
+            out[i] = stripNamespace(s)
+        default:
+            out[i] = k
+        }
+    }
+    return out
+}
+
+func redisArgString(v interface{}) string {
+    if bs, ok := v.([]byte); ok {
+        return string(bs)
+    }
+    return fmt.Sprint(v)
+}
+
+//锁键为数字, 将命名空间与原始键一起做hash得到storage中实际使用的键
+func namespaceLockKey(key uint64) uint64 {
+    if storageNamespace == "" {
+        return key
+    }
+    h := fnv.New64a()
+    h.Write([]byte(storageNamespace))
+    var bs [8]byte
+    binary.BigEndian.PutUint64(bs[:], key)
+    h.Write(bs[:])
+    return h.Sum64()
+}
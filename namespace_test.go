@@ -0,0 +1,56 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestNamespaceRedisArgs(t *testing.T) {
+    defer func(ns string) {
+        storageNamespace = ns
+    }(storageNamespace)
+    storageNamespace = "qa*:"
+
+    cases := []struct {
+        cmd  string
+        args []interface{}
+        want []interface{}
+    }{
+        {"GET", []interface{}{"k"}, []interface{}{"qa*:k"}},
+        {"mset", []interface{}{"a", 1, "b", 2}, []interface{}{"qa*:a", 1, "qa*:b", 2}},
+        {"PUBLISH", []interface{}{"news", "hi"}, []interface{}{"qa*:news", "hi"}},
+        {"keys", []interface{}{"user:*"}, []interface{}{`qa\*:user:*`}},
+        {"keys", nil, []interface{}{`qa\*:*`}},
+        {"scan", []interface{}{"0", "match", []byte("u*"), "COUNT", 10}, []interface{}{"0", "match", `qa\*:u*`, "COUNT", 10}},
+        {"SCAN", []interface{}{"0", "COUNT", 10}, []interface{}{"0", "COUNT", 10, "MATCH", `qa\*:*`}},
+        {"hscan", []interface{}{"h", "0", "MATCH", "f*"}, []interface{}{"qa*:h", "0", "MATCH", "f*"}},
+        {"eval", []interface{}{"return 1", "1", "k", "arg"}, []interface{}{"return 1", "1", "qa*:k", "arg"}},
+    }
+    for _, c := range cases {
+        if got := namespaceRedisArgs(c.cmd, c.args); !reflect.DeepEqual(got, c.want) {
+            t.Errorf("%s %v: got %v, want %v", c.cmd, c.args, got, c.want)
+        }
+    }
+}
+
+func TestUnnamespaceRedisReply(t *testing.T) {
+    defer func(ns string) {
+        storageNamespace = ns
+    }(storageNamespace)
+    storageNamespace = "qa:"
+
+    keys := unnamespaceRedisReply("KEYS", []interface{}{[]byte("qa:a"), []byte("qa:b")})
+    if want := []interface{}{[]byte("a"), []byte("b")}; !reflect.DeepEqual(keys, want) {
+        t.Errorf("keys: got %v", keys)
+    }
+    scan := unnamespaceRedisReply("scan", []interface{}{[]byte("7"), []interface{}{[]byte("qa:a")}})
+    if want := []interface{}{[]byte("7"), []interface{}{[]byte("a")}}; !reflect.DeepEqual(scan, want) {
+        t.Errorf("scan: got %v", scan)
+    }
+    if got := unnamespaceRedisReply("get", []byte("qa:a")); !reflect.DeepEqual(got, []byte("qa:a")) {
+        t.Errorf("get: got %v", got)
+    }
+    if ch := namespaceChannel("news"); ch != "qa:news" || stripNamespace(ch) != "news" {
+        t.Errorf("channel: got %s", ch)
+    }
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/packing/clove/utils"
+    "github.com/packing/goja"
+)
+
+var (
+    addrPubSub = ""
+
+    pubSubLock     sync.Mutex
+    pubSubChannels = make(map[string]bool)
+    pubSubConn     net.Conn
+    pubSubStopCh   chan int
+
+    //每个频道一个有序队列和一个worker, 同时执行的worker数不超过pubSubSlots的容量, 避免占满上下文池
+    pubSubQueueSize = 1024
+    pubSubQueues    = make(map[string]chan string)
+    pubSubSlots     chan int
+    pubSubDropped   int64
+)
+
+func writeRESPCommand(w *bufio.Writer, args ...string) error {
+    fmt.Fprintf(w, "*%d\r\n", len(args))
+    for _, a := range args {
+        fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a)
+    }
+    return w.Flush()
+}
+
+func readRESPLine(r *bufio.Reader) (string, error) {
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return "", err
+    }
+    if len(line) < 3 || line[len(line)-2] != '\r' {
+        return "", errors.New("redis protocol error")
+    }
+    return line[:len(line)-2], nil
+}
+
+//仅解析订阅场景所需的RESP类型
+func readRESPReply(r *bufio.Reader) (interface{}, error) {
+    line, err := readRESPLine(r)
+    if err != nil {
+        return nil, err
+    }
+    switch line[0] {
+    case '+':
+        return line[1:], nil
+    case '-':
+        return nil, errors.New(line[1:])
+    case ':':
+        return strconv.ParseInt(line[1:], 10, 64)
+    case '$':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        if n < 0 {
+            return nil, nil
+        }
+        buf := make([]byte, n+2)
+        if _, err := io.ReadFull(r, buf); err != nil {
+            return nil, err
+        }
+        return buf[:n], nil
+    case '*':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        if n < 0 {
+            return nil, nil
+        }
+        arr := make([]interface{}, n)
+        for i := 0; i < n; i++ {
+            if arr[i], err = readRESPReply(r); err != nil {
+                return nil, err
+            }
+        }
+        return arr, nil
+    }
+    return nil, errors.New("redis protocol error")
+}
+
+func respString(v interface{}) string {
+    switch s := v.(type) {
+    case []byte:
+        return string(s)
+    case string:
+        return s
+    }
+    return ""
+}
+
+func subscribeChannel(channel string) {
+    pubSubLock.Lock()
+    defer pubSubLock.Unlock()
+    if pubSubChannels[channel] {
+        return
+    }
+    pubSubChannels[channel] = true
+    if pubSubConn != nil {
+        writeRESPCommand(bufio.NewWriter(pubSubConn), "SUBSCRIBE", namespaceChannel(channel))
+    }
+}
+
+func dispatchPubSubEvent(channel string, payload string) {
+    defer func() {
+        utils.LogPanic(recover())
+    }()
+    vm := borrowGojaVM()
+    if vm == nil {
+        return
+    }
+    defer returnGojaVM(vm)
+    vm.DispatchEvent(channel, payload)
+}
+
+func runPubSubWorker(channel string, queue chan string, stop chan int) {
+    for {
+        select {
+        case <-stop:
+            return
+        case payload := <-queue:
+            select {
+            case <-stop:
+                return
+            case pubSubSlots <- 1:
+            }
+            dispatchPubSubEvent(channel, payload)
+            <-pubSubSlots
+        }
+    }
+}
+
+//队列满时丢弃消息, 不阻塞订阅连接的读取
+func enqueuePubSubEvent(channel string, payload string) {
+    pubSubLock.Lock()
+    queue, ok := pubSubQueues[channel]
+    if !ok {
+        queue = make(chan string, pubSubQueueSize)
+        pubSubQueues[channel] = queue
+        go runPubSubWorker(channel, queue, pubSubStopCh)
+    }
+    pubSubLock.Unlock()
+
+    select {
+    case queue <- payload:
+    default:
+        pubSubLock.Lock()
+        pubSubDropped++
+        pubSubLock.Unlock()
+        utils.LogError("!!!redis订阅频道 %s 待处理消息已满, 丢弃消息", channel)
+    }
+}
+
+func runPubSub(addr, password string) error {
+    conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    r := bufio.NewReader(conn)
+    w := bufio.NewWriter(conn)
+    if password != "" {
+        if err := writeRESPCommand(w, "AUTH", password); err != nil {
+            return err
+        }
+        if _, err := readRESPReply(r); err != nil {
+            return err
+        }
+    }
+
+    pubSubLock.Lock()
+    channels := make([]string, 0, len(pubSubChannels))
+    for c := range pubSubChannels {
+        channels = append(channels, namespaceChannel(c))
+    }
+    if len(channels) > 0 {
+        err = writeRESPCommand(w, append([]string{"SUBSCRIBE"}, channels...)...)
+    }
+    if err == nil {
+        pubSubConn = conn
+    }
+    pubSubLock.Unlock()
+    if err != nil {
+        return err
+    }
+
+    defer func() {
+        pubSubLock.Lock()
+        pubSubConn = nil
+        pubSubLock.Unlock()
+    }()
+
+    utils.LogInfo(">>> 已连接redis订阅 %s %v", addr, channels)
+
+    for {
+        reply, err := readRESPReply(r)
+        if err != nil {
+            return err
+        }
+        arr, ok := reply.([]interface{})
+        if !ok || len(arr) < 3 {
+            continue
+        }
+        if strings.ToLower(respString(arr[0])) == "message" {
+            enqueuePubSubEvent(stripNamespace(respString(arr[1])), respString(arr[2]))
+        }
+    }
+}
+
+//断线后按退避间隔重连, 并重新订阅所有已声明的频道
+func startPubSub() {
+    if addrPubSub == "" {
+        return
+    }
+    addr := addrPubSub
+    password := ""
+    if i := strings.LastIndex(addr, "@"); i >= 0 {
+        password = addr[:i]
+        addr = addr[i+1:]
+    }
+
+    workers := cpuNum / 2
+    if workers < 1 {
+        workers = 1
+    }
+    pubSubSlots = make(chan int, workers)
+    pubSubStopCh = make(chan int)
+    go func() {
+        backoff := time.Second
+        for {
+            tb := time.Now()
+            err := runPubSub(addr, password)
+            select {
+            case <-pubSubStopCh:
+                return
+            default:
+            }
+            if time.Since(tb) > 30*time.Second {
+                backoff = time.Second
+            }
+            utils.LogError("!!!redis订阅连接断开 %s, %s后重连", err, backoff)
+            select {
+            case <-pubSubStopCh:
+                return
+            case <-time.After(backoff):
+            }
+            if backoff < 30*time.Second {
+                backoff *= 2
+            }
+        }
+    }()
+}
+
+func stopPubSub() {
+    if pubSubStopCh == nil {
+        return
+    }
+    close(pubSubStopCh)
+    pubSubLock.Lock()
+    if pubSubConn != nil {
+        pubSubConn.Close()
+    }
+    pubSubLock.Unlock()
+}
+
+func init() {
+    registerMetrics("pubsub", func() interface{} {
+        pubSubLock.Lock()
+        defer pubSubLock.Unlock()
+        pending := make(map[string]int, len(pubSubQueues))
+        for channel, queue := range pubSubQueues {
+            pending[channel] = len(queue)
+        }
+        return map[string]interface{}{
+            "pending": pending,
+            "dropped": pubSubDropped,
+        }
+    })
+}
+
+func (n GojaVMNet) Subscribe(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 {
+        return n.vm.Runtime.ToValue(false)
+    }
+    if !gojaInitializing {
+        stacks := make([]goja.StackFrame, 5)
+        errStr := GenGojaStackFrameString(n.vm, "[J] !!! redis.subscribe can only be called in __init__", n.vm.Runtime.CaptureCallStack(5, stacks))
+        utils.LogError(errStr)
+        return n.vm.Runtime.ToValue(false)
+    }
+    if addrPubSub == "" {
+        stacks := make([]goja.StackFrame, 5)
+        errStr := GenGojaStackFrameString(n.vm, "[J] !!! redis pubsub addr is not configured", n.vm.Runtime.CaptureCallStack(5, stacks))
+        utils.LogError(errStr)
+        return n.vm.Runtime.ToValue(false)
+    }
+    for _, a := range call.Arguments {
+        subscribeChannel(a.String())
+    }
+    return n.vm.Runtime.ToValue(true)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+    "container/list"
+    "fmt"
+    "regexp"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/packing/goja"
+)
+
+type queryCacheEntry struct {
+    key     string
+    rows    []interface{}
+    tags    []string
+    size    int
+    expires time.Time
+}
+
+type QueryCacheStat struct {
+    Hits          uint64 `json:"hits"`
+    Misses        uint64 `json:"misses"`
+    Evictions     uint64 `json:"evictions"`
+    Invalidations uint64 `json:"invalidations"`
+    Entries       int    `json:"entries"`
+    Bytes         int    `json:"bytes"`
+}
+
+var (
+    queryCacheMaxEntries = 10000
+    queryCacheMaxBytes   = 64 << 20
+
+    queryCacheLock  sync.Mutex
+    queryCacheLRU   = list.New()
+    queryCacheItems = make(map[string]*list.Element)
+    queryCacheTags  = make(map[string]map[*list.Element]struct{})
+    queryCacheStat  QueryCacheStat
+
+    sqlTokenPattern     = regexp.MustCompile("[`\\w.$]+|\\S")
+    sqlTableNamePattern = regexp.MustCompile("^[`\\w$][`\\w.$]*$")
+
+    //其后跟随表名列表的关键字
+    sqlTableKeywords = map[string]bool{
+        "from": true, "join": true, "into": true, "update": true,
+        "table": true, "truncate": true, "replace": true,
+    }
+    //关键字与表名之间可能出现的修饰词
+    sqlTableModifiers = map[string]bool{
+        "low_priority": true, "high_priority": true, "delayed": true, "quick": true,
+        "ignore": true, "into": true, "table": true, "tables": true, "if": true, "not": true, "exists": true,
+    }
+    //表名之后出现这些词时不是别名
+    sqlAliasStops = map[string]bool{
+        "where": true, "set": true, "on": true, "using": true, "values": true, "value": true,
+        "select": true, "group": true, "order": true, "limit": true, "having": true, "union": true,
+        "join": true, "left": true, "right": true, "inner": true, "outer": true, "cross": true,
+        "natural": true, "straight_join": true, "for": true, "lock": true, "partition": true,
+        "window": true, "from": true, "into": true, "add": true, "drop": true, "modify": true,
+        "change": true, "rename": true, "to": true, "like": true,
+    }
+    //结构变更语句无法可靠地对应到缓存标签, 直接清空全部缓存
+    sqlDDLKeywords = map[string]bool{
+        "alter": true, "drop": true, "truncate": true, "rename": true, "create": true,
+    }
+)
+
+//语句中涉及的表名作为隐式标签, exec修改某表时使相关查询失效.
+//支持逗号分隔的多表, 别名, 以及带库名的表名
+func sqlTables(sql string) []string {
+    tokens := sqlTokenPattern.FindAllString(sql, -1)
+    var tables []string
+    for i := 0; i < len(tokens); i++ {
+        if !sqlTableKeywords[strings.ToLower(tokens[i])] {
+            continue
+        }
+        for i+1 < len(tokens) && sqlTableModifiers[strings.ToLower(tokens[i+1])] {
+            i++
+        }
+        for i+1 < len(tokens) && sqlTableNamePattern.MatchString(tokens[i+1]) {
+            t := strings.ToLower(strings.Replace(tokens[i+1], "`", "", -1))
+            if j := strings.LastIndexByte(t, '.'); j >= 0 {
+                t = t[j+1:]
+            }
+            if t == "" || t == "select" {
+                break
+            }
+            tables = append(tables, t)
+            i++
+            if i+1 < len(tokens) && strings.ToLower(tokens[i+1]) == "as" {
+                i += 2
+            } else if i+1 < len(tokens) && sqlTableNamePattern.MatchString(tokens[i+1]) && !sqlAliasStops[strings.ToLower(tokens[i+1])] {
+                i++
+            }
+            if i+1 >= len(tokens) || tokens[i+1] != "," {
+                break
+            }
+            i++
+        }
+    }
+    return tables
+}
+
+func sqlIsDDL(sql string) bool {
+    fields := strings.Fields(sql)
+    return len(fields) > 0 && sqlDDLKeywords[strings.ToLower(fields[0])]
+}
+
+func queryCacheKey(backend string, sql string, args []interface{}) string {
+    return backend + "\x00" + sql + "\x00" + fmt.Sprintf("%#v", args)
+}
+
+//不同后端可能存在同名的表, 标签按后端区分, 一个后端的exec不会使其他后端的缓存失效
+func queryCacheTag(backend string, tag string) string {
+    return backend + "\x00" + strings.ToLower(tag)
+}
+
+func queryCacheBackendTags(backend string, tags []string) []string {
+    out := make([]string, 0, len(tags))
+    for _, t := range tags {
+        out = append(out, queryCacheTag(backend, t))
+    }
+    return out
+}
+
+//粗略估算结果集占用的内存
+func rowsSize(v interface{}) int {
+    switch r := v.(type) {
+    case []byte:
+        return len(r) + 24
+    case string:
+        return len(r) + 16
+    case []interface{}:
+        n := 24
+        for _, item := range r {
+            n += rowsSize(item)
+        }
+        return n
+    case map[interface{}]interface{}:
+        n := 48
+        for k, item := range r {
+            n += rowsSize(k) + rowsSize(item)
+        }
+        return n
+    }
+    return 16
+}
+
+func queryCacheGet(key string) ([]interface{}, bool) {
+    queryCacheLock.Lock()
+    defer queryCacheLock.Unlock()
+    el, ok := queryCacheItems[key]
+    if ok {
+        e := el.Value.(*queryCacheEntry)
+        if time.Now().Before(e.expires) {
+            queryCacheLRU.MoveToFront(el)
+            queryCacheStat.Hits++
+            return e.rows, true
+        }
+        queryCacheRemove(el)
+    }
+    queryCacheStat.Misses++
+    return nil, false
+}
+
+func queryCachePut(key string, rows []interface{}, tags []string, ttl time.Duration) {
+    size := rowsSize(rows) + len(key)
+    if queryCacheMaxBytes <= 0 || size > queryCacheMaxBytes {
+        return
+    }
+
+    queryCacheLock.Lock()
+    defer queryCacheLock.Unlock()
+    if el, ok := queryCacheItems[key]; ok {
+        queryCacheRemove(el)
+    }
+    e := &queryCacheEntry{key: key, rows: rows, tags: tags, size: size, expires: time.Now().Add(ttl)}
+    el := queryCacheLRU.PushFront(e)
+    queryCacheItems[key] = el
+    for _, t := range tags {
+        set, ok := queryCacheTags[t]
+        if !ok {
+            set = make(map[*list.Element]struct{})
+            queryCacheTags[t] = set
+        }
+        set[el] = struct{}{}
+    }
+    queryCacheStat.Entries++
+    queryCacheStat.Bytes += size
+
+    for queryCacheStat.Entries > queryCacheMaxEntries || queryCacheStat.Bytes > queryCacheMaxBytes {
+        back := queryCacheLRU.Back()
+        if back == nil {
+            break
+        }
+        queryCacheRemove(back)
+        queryCacheStat.Evictions++
+    }
+}
+
+//调用方需持有queryCacheLock
+func queryCacheRemove(el *list.Element) {
+    e := el.Value.(*queryCacheEntry)
+    queryCacheLRU.Remove(el)
+    delete(queryCacheItems, e.key)
+    for _, t := range e.tags {
+        if set, ok := queryCacheTags[t]; ok {
+            delete(set, el)
+            if len(set) == 0 {
+                delete(queryCacheTags, t)
+            }
+        }
+    }
+    queryCacheStat.Entries--
+    queryCacheStat.Bytes -= e.size
+}
+
+func queryCacheInvalidate(backend string, tags ...string) int {
+    queryCacheLock.Lock()
+    defer queryCacheLock.Unlock()
+    n := 0
+    for _, t := range tags {
+        for el := range queryCacheTags[queryCacheTag(backend, t)] {
+            queryCacheRemove(el)
+            n++
+        }
+    }
+    queryCacheStat.Invalidations += uint64(n)
+    return n
+}
+
+func queryCacheFlush() int {
+    queryCacheLock.Lock()
+    defer queryCacheLock.Unlock()
+    n := queryCacheStat.Entries
+    queryCacheLRU.Init()
+    queryCacheItems = make(map[string]*list.Element)
+    queryCacheTags = make(map[string]map[*list.Element]struct{})
+    queryCacheStat.Entries = 0
+    queryCacheStat.Bytes = 0
+    queryCacheStat.Invalidations += uint64(n)
+    return n
+}
+
+//清空单个后端的缓存
+func queryCacheFlushBackend(backend string) int {
+    queryCacheLock.Lock()
+    defer queryCacheLock.Unlock()
+    prefix := backend + "\x00"
+    n := 0
+    for key, el := range queryCacheItems {
+        if strings.HasPrefix(key, prefix) {
+            queryCacheRemove(el)
+            n++
+        }
+    }
+    queryCacheStat.Invalidations += uint64(n)
+    return n
+}
+
+//exec之后使该后端受影响的缓存失效
+func queryCacheInvalidateSQL(backend string, sql string) {
+    if sqlIsDDL(sql) {
+        queryCacheFlushBackend(backend)
+        return
+    }
+    queryCacheInvalidate(backend, sqlTables(sql)...)
+}
+
+//opts.cache为缓存毫秒数, opts.tags为额外的失效标签
+func queryCacheOptions(opts *goja.Object) (time.Duration, []string) {
+    if opts == nil {
+        return 0, nil
+    }
+    v := opts.Get("cache")
+    if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+        return 0, nil
+    }
+    ttl := time.Duration(v.ToInteger()) * time.Millisecond
+    var tags []string
+    if t := opts.Get("tags"); t != nil && !goja.IsUndefined(t) && !goja.IsNull(t) {
+        if list, ok := t.Export().([]interface{}); ok {
+            for _, item := range list {
+                tags = append(tags, strings.ToLower(fmt.Sprint(item)))
+            }
+        } else {
+            tags = append(tags, strings.ToLower(t.String()))
+        }
+    }
+    return ttl, tags
+}
+
+//mysql.invalidate(tag, ...) 返回当前后端失效的缓存条数
+func (n GojaVMNet) Invalidate(call goja.FunctionCall) goja.Value {
+    tags := make([]string, 0, len(call.Arguments))
+    for _, a := range call.Arguments {
+        tags = append(tags, a.String())
+    }
+    return n.vm.Runtime.ToValue(queryCacheInvalidate(n.backendName(), tags...))
+}
+
+func init() {
+    registerMetrics("queryCache", func() interface{} {
+        queryCacheLock.Lock()
+        defer queryCacheLock.Unlock()
+        return queryCacheStat
+    })
+}
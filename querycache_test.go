@@ -0,0 +1,103 @@
+package main
+
+import (
+    "fmt"
+    "reflect"
+    "testing"
+    "time"
+
+    "github.com/packing/goja"
+)
+
+func TestSqlTables(t *testing.T) {
+    cases := map[string][]string{
+        "SELECT * FROM users WHERE id = ?":                               {"users"},
+        "select a.id from `game`.`users` a join items b on a.id = b.uid": {"users", "items"},
+        "SELECT * FROM users u, items AS i WHERE u.id = i.uid":           {"users", "items"},
+        "SELECT * FROM (SELECT id FROM users) t":                         {"users"},
+        "INSERT IGNORE INTO logs (a, b) VALUES (?, ?)":                   {"logs"},
+        "REPLACE INTO game.scores SET score = ?":                         {"scores"},
+        "REPLACE `game`.`scores` VALUES (?, ?)":                          {"scores"},
+        "UPDATE LOW_PRIORITY users u, items i SET u.a = i.b":             {"users", "items"},
+        "DELETE t FROM game.orders t JOIN users u ON t.uid = u.id":       {"orders", "users"},
+        "DELETE QUICK FROM orders WHERE id = ?":                          {"orders"},
+        "TRUNCATE game.orders":                                           {"orders"},
+        "TRUNCATE TABLE orders":                                          {"orders"},
+        "ALTER TABLE `game`.`orders` ADD COLUMN x INT":                   {"orders"},
+        "DROP TABLE IF EXISTS a, b":                                      {"a", "b"},
+        "SELECT REPLACE(name, 'a', 'b') FROM users":                      {"users"},
+    }
+    for sql, want := range cases {
+        if got := sqlTables(sql); !reflect.DeepEqual(got, want) {
+            t.Errorf("%s: got %v, want %v", sql, got, want)
+        }
+    }
+}
+
+func TestQueryCacheInvalidateSQL(t *testing.T) {
+    defer queryCacheFlush()
+
+    put := func(backend string, key string, sql string) {
+        queryCachePut(queryCacheKey(backend, sql, nil), []interface{}{key}, queryCacheBackendTags(backend, sqlTables(sql)), time.Minute)
+    }
+    cached := func(backend string, sql string) bool {
+        _, ok := queryCacheGet(queryCacheKey(backend, sql, nil))
+        return ok
+    }
+    put("", "q1", "SELECT * FROM users")
+    put("", "q2", "SELECT * FROM items")
+    put("logs", "q3", "SELECT * FROM users")
+
+    queryCacheInvalidateSQL("", "DELETE u FROM `game`.`users` u WHERE u.id = ?")
+    if cached("", "SELECT * FROM users") {
+        t.Error("q1 should be invalidated")
+    }
+    if !cached("", "SELECT * FROM items") {
+        t.Error("q2 should still be cached")
+    }
+    if !cached("logs", "SELECT * FROM users") {
+        t.Error("q3 belongs to another backend and should still be cached")
+    }
+
+    queryCacheInvalidateSQL("", "ALTER TABLE other ADD COLUMN x INT")
+    if cached("", "SELECT * FROM items") {
+        t.Error("ddl should flush the backend cache")
+    }
+    if !cached("logs", "SELECT * FROM users") {
+        t.Error("ddl should not flush another backend")
+    }
+
+    if n := queryCacheInvalidate("logs", "USERS"); n != 1 {
+        t.Errorf("invalidated %d entries by tag", n)
+    }
+}
+
+func TestMysqlStatementOptions(t *testing.T) {
+    vm := &GojaVM{Runtime: goja.New()}
+    n := GojaVMNet{vm: vm}
+    vm.Runtime.Set("statement", func(call goja.FunctionCall) goja.Value {
+        sql, args, opts := n.mysqlStatement(call)
+        cache := int64(0)
+        if opts != nil {
+            cache = opts.Get("cache").ToInteger()
+        }
+        return vm.Runtime.ToValue(fmt.Sprint(sql, args, cache))
+    })
+    cases := map[string]string{
+        `statement("q ?", 1)`:                      "q ?[1] 0",
+        `statement("q ?, ?", 1, 2, {cache: 500})`:  "q ?, ?[1 2] 500",
+        `statement("q ?", 1, {cache: 500, x: 1})`:  "q ?[1 map[cache:500 x:1]] 0",
+        `statement("q ?", [1], {cache: 500})`:      "q ?[1] 500",
+        `statement("q :a", {a: 1}, {cache: 500})`:  "q ?[1] 500",
+    }
+    for src, want := range cases {
+        v, err := vm.Runtime.RunString(src)
+        if err != nil {
+            t.Errorf("%s: %v", src, err)
+            continue
+        }
+        if got := v.String(); got != want {
+            t.Errorf("%s: got %s, want %s", src, got, want)
+        }
+    }
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+    "errors"
+    "os"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "github.com/packing/clove/codecs"
+    "github.com/packing/clove/storage"
+    "github.com/packing/goja"
+)
+
+var (
+    redisConnSerial uint32
+
+    ErrorRedisOpen  = errors.New("redis open failed")
+    ErrorRedisSend  = errors.New("redis send failed")
+    ErrorRedisFlush = errors.New("redis flush failed")
+)
+
+type redisCommand struct {
+    cmd  string
+    args []interface{}
+}
+
+type redisReply struct {
+    value interface{}
+    err   error
+}
+
+//storage以key区分连接, 会话ID作为key时不会设置最高位, 再拼入进程号避免与其他slave冲突
+func allocRedisKey() uint64 {
+    serial := atomic.AddUint32(&redisConnSerial, 1)
+    return 1<<63 | uint64(os.Getpid()&0x7fffffff)<<32 | uint64(serial)
+}
+
+//对象与数组按IMv2编码后再交给redis, 与redis.cmd保持一致
+func redisArgs(values []goja.Value) []interface{} {
+    args := make([]interface{}, 0, len(values))
+    for _, a := range values {
+        v := a.Export()
+        switch v.(type) {
+        case map[string]interface{}:
+            var sv codecs.IMData = transferGojaMap2GoMap(v.(map[string]interface{}))
+            err, bs := codecs.CodecIMv2.Encoder.Encode(&sv)
+            if err == nil {
+                args = append(args, bs)
+                continue
+            }
+        case []interface{}:
+            var sv codecs.IMData = transferGojaArray2GoArray(v.([]interface{}))
+            err, bs := codecs.CodecIMv2.Encoder.Encode(&sv)
+            if err == nil {
+                args = append(args, bs)
+                continue
+            }
+        }
+        args = append(args, v)
+    }
+    return args
+}
+
+func redisDecodeOption(v goja.Value) bool {
+    obj, ok := v.(*goja.Object)
+    if !ok {
+        return false
+    }
+    d := obj.Get("decode")
+    return d != nil && d.ToBoolean()
+}
+
+func redisBlobValue(vm *GojaVM, bs []byte, decode bool) goja.Value {
+    if decode {
+        err, obj, remain := codecs.CodecIMv2.Decoder.Decode(bs)
+        if err == nil && len(remain) == 0 {
+            switch obj.(type) {
+            case map[interface{}]interface{}:
+                return vm.Runtime.ToValue(transferGoMap2GojaMap(obj.(map[interface{}]interface{})))
+            case []interface{}:
+                return vm.Runtime.ToValue(transferGoArray2GojaArray(obj.([]interface{})))
+            }
+            return vm.Runtime.ToValue(obj)
+        }
+    }
+    return vm.Runtime.ToValue(string(bs))
+}
+
+//按redis回复类型转换: 整数为number, 空回复为null, 数组逐项转换.
+//IMv2没有错误类型, storage对错误回复只写日志并返回nil, 脚本中得到的同样是null
+func redisValue(vm *GojaVM, rows interface{}, decode bool) goja.Value {
+    switch v := rows.(type) {
+    case nil:
+        return goja.Null()
+    case []byte:
+        return redisBlobValue(vm, v, decode)
+    case []interface{}:
+        out := make([]interface{}, len(v))
+        for i, item := range v {
+            out[i] = redisValue(vm, item, decode)
+        }
+        return vm.Runtime.ToValue(out)
+    case map[interface{}]interface{}:
+        return vm.Runtime.ToValue(transferGoMap2GojaMap(v))
+    }
+    return vm.Runtime.ToValue(rows)
+}
+
+//在独立连接上依次发送全部命令, 一次flush后按顺序收取结果并关闭连接
+func runRedisPipeline(client *storage.Client, cmds []redisCommand) []redisReply {
+    replies := make([]redisReply, len(cmds))
+    key := allocRedisKey()
+    if !client.RedisOpen(key) {
+        for i := range replies {
+            replies[i].err = ErrorRedisOpen
+        }
+        return replies
+    }
+    defer client.RedisClose(key)
+
+    sent := make([]bool, len(cmds))
+    for i, c := range cmds {
+        sent[i] = client.RedisSend(key, c.cmd, namespaceRedisArgs(c.cmd, c.args)...)
+        if !sent[i] {
+            replies[i].err = ErrorRedisSend
+        }
+    }
+
+    if !client.RedisFlush(key) {
+        for i := range replies {
+            if sent[i] {
+                replies[i].err = ErrorRedisFlush
+            }
+        }
+        return replies
+    }
+
+    for i := range cmds {
+        if sent[i] {
+            replies[i].value = unnamespaceRedisReply(cmds[i].cmd, client.RedisReceive(key))
+        }
+    }
+    return replies
+}
+
+func (n GojaVMNet) observePipeline(client *storage.Client, cmds []redisCommand) []redisReply {
+    names := make([]interface{}, len(cmds))
+    for i, c := range cmds {
+        names[i] = strings.ToUpper(c.cmd)
+    }
+    tb := time.Now()
+    replies := runRedisPipeline(client, cmds)
+    n.observeStorage("redis", "pipeline", names, tb)
+    if pipelineOk(replies) {
+        n.storageBackend().recordSuccess()
+    } else {
+        n.storageBackend().recordFailure()
+    }
+    return replies
+}
+
+//只有打开/发送/flush失败才计为存储故障, nil回复可能只是key不存在
+func pipelineOk(replies []redisReply) bool {
+    for _, r := range replies {
+        if r.err != nil {
+            return false
+        }
+    }
+    return true
+}
+
+//结果与ioredis一致, 每条命令对应一个[err, result]
+func (n GojaVMNet) pipelineResult(replies []redisReply, decode bool) goja.Value {
+    out := make([]interface{}, len(replies))
+    for i, r := range replies {
+        if r.err != nil {
+            out[i] = []interface{}{n.vm.Runtime.NewGoError(r.err), nil}
+        } else {
+            out[i] = []interface{}{nil, redisValue(n.vm, r.value, decode)}
+        }
+    }
+    return n.vm.Runtime.ToValue(out)
+}
+
+func (n GojaVMNet) redisCommandOf(v goja.Value) redisCommand {
+    obj, ok := v.(*goja.Object)
+    if !ok {
+        panic(n.vm.Runtime.NewTypeError("redis pipeline command must be an array"))
+    }
+    var parts []goja.Value
+    if err := n.vm.Runtime.ExportTo(obj, &parts); err != nil || len(parts) == 0 {
+        panic(n.vm.Runtime.NewTypeError("redis pipeline command must be a non-empty array"))
+    }
+    return redisCommand{cmd: parts[0].String(), args: redisArgs(parts[1:])}
+}
+
+//redis.pipeline([[cmd, ...args], ...], {decode: true})
+func (n GojaVMNet) Pipeline(call goja.FunctionCall) goja.Value {
+    client := n.storage()
+    if client == nil {
+        panic(n.vm.Runtime.NewGoError(errors.New("redis is not available")))
+    }
+    if len(call.Arguments) == 0 {
+        panic(n.vm.Runtime.NewTypeError("redis.pipeline requires an array of commands"))
+    }
+
+    var list []goja.Value
+    if err := n.vm.Runtime.ExportTo(call.Arguments[0], &list); err != nil {
+        panic(n.vm.Runtime.NewTypeError("redis.pipeline requires an array of commands"))
+    }
+    cmds := make([]redisCommand, 0, len(list))
+    for _, v := range list {
+        cmds = append(cmds, n.redisCommandOf(v))
+    }
+    if len(cmds) == 0 {
+        return n.vm.Runtime.ToValue([]interface{}{})
+    }
+    return n.pipelineResult(n.observePipeline(client, cmds), redisDecodeOption(call.Argument(1)))
+}
+
+//redis.batch(function (b) { b.cmd("GET", k1); b.cmd("INCR", k2) }, {decode: true})
+func (n GojaVMNet) Batch(call goja.FunctionCall) goja.Value {
+    client := n.storage()
+    if client == nil {
+        panic(n.vm.Runtime.NewGoError(errors.New("redis is not available")))
+    }
+    fn, ok := goja.AssertFunction(call.Argument(0))
+    if !ok {
+        panic(n.vm.Runtime.NewTypeError("redis.batch requires a function"))
+    }
+
+    var cmds []redisCommand
+    b := n.vm.Runtime.NewObject()
+    b.Set("cmd", func(c goja.FunctionCall) goja.Value {
+        if len(c.Arguments) == 0 {
+            panic(n.vm.Runtime.NewTypeError("batch.cmd requires a command"))
+        }
+        cmds = append(cmds, redisCommand{cmd: c.Arguments[0].String(), args: redisArgs(c.Arguments[1:])})
+        return b
+    })
+
+    if _, err := fn(goja.Undefined(), b); err != nil {
+        panic(err)
+    }
+    if len(cmds) == 0 {
+        return n.vm.Runtime.ToValue([]interface{}{})
+    }
+    return n.pipelineResult(n.observePipeline(client, cmds), redisDecodeOption(call.Argument(1)))
+}
+
+type redisConn struct {
+    client *storage.Client
+    key    uint64
+    closed bool
+}
+
+func (vm *GojaVM) closeRedisConn(c *redisConn) bool {
+    if c.closed {
+        return false
+    }
+    c.closed = true
+    for i, o := range vm.redisConns {
+        if o == c {
+            vm.redisConns = append(vm.redisConns[:i], vm.redisConns[i+1:]...)
+            break
+        }
+    }
+    return c.client.RedisClose(c.key)
+}
+
+//VM归还到池时关闭脚本遗留的连接
+func (vm *GojaVM) closeAllRedisConns() {
+    for _, c := range vm.redisConns {
+        c.closed = true
+        c.client.RedisClose(c.key)
+    }
+    vm.redisConns = vm.redisConns[:0]
+}
+
+func (n GojaVMNet) checkRedisConn(c *redisConn, op string) {
+    if c.closed {
+        panic(n.vm.Runtime.NewGoError(errors.New("redis connection is closed before executing " + op)))
+    }
+}
+
+//redis.connect({decode: true})返回独立的固定连接, 同一次分派中可以同时持有多个
+func (n GojaVMNet) Connect(call goja.FunctionCall) goja.Value {
+    client := n.storage()
+    if client == nil {
+        panic(n.vm.Runtime.NewGoError(errors.New("redis is not available")))
+    }
+
+    decode := redisDecodeOption(call.Argument(0))
+    c := &redisConn{client: client, key: allocRedisKey()}
+    if !c.client.RedisOpen(c.key) {
+        panic(n.vm.Runtime.NewGoError(ErrorRedisOpen))
+    }
+    n.vm.redisConns = append(n.vm.redisConns, c)
+
+    o := n.vm.Runtime.NewObject()
+    o.Set("send", func(call goja.FunctionCall) goja.Value {
+        n.checkRedisConn(c, "send")
+        if len(call.Arguments) == 0 {
+            panic(n.vm.Runtime.NewTypeError("send requires a command"))
+        }
+        cmd := call.Arguments[0].String()
+        b := c.client.RedisSend(c.key, cmd, namespaceRedisArgs(cmd, redisArgs(call.Arguments[1:]))...)
+        return n.vm.Runtime.ToValue(b)
+    })
+    o.Set("flush", func(call goja.FunctionCall) goja.Value {
+        n.checkRedisConn(c, "flush")
+        return n.vm.Runtime.ToValue(c.client.RedisFlush(c.key))
+    })
+    o.Set("receive", func(call goja.FunctionCall) goja.Value {
+        n.checkRedisConn(c, "receive")
+        return redisValue(n.vm, c.client.RedisReceive(c.key), decode)
+    })
+    o.Set("do", func(call goja.FunctionCall) goja.Value {
+        n.checkRedisConn(c, "do")
+        if len(call.Arguments) == 0 {
+            panic(n.vm.Runtime.NewTypeError("do requires a command"))
+        }
+        cmd := call.Arguments[0].String()
+        args := namespaceRedisArgs(cmd, redisArgs(call.Arguments[1:]))
+        tb := time.Now()
+        if !c.client.RedisSend(c.key, cmd, args...) {
+            panic(n.vm.Runtime.NewGoError(ErrorRedisSend))
+        }
+        if !c.client.RedisFlush(c.key) {
+            panic(n.vm.Runtime.NewGoError(ErrorRedisFlush))
+        }
+        rows := unnamespaceRedisReply(cmd, c.client.RedisReceive(c.key))
+        n.observeStorage("redis", strings.ToUpper(cmd), args, tb)
+        return redisValue(n.vm, rows, decode)
+    })
+    o.Set("close", func(call goja.FunctionCall) goja.Value {
+        return n.vm.Runtime.ToValue(n.vm.closeRedisConn(c))
+    })
+    return o
+}
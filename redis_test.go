@@ -0,0 +1,76 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/packing/clove/codecs"
+    "github.com/packing/goja"
+)
+
+func redisJSON(t *testing.T, vm *GojaVM, v goja.Value) string {
+    vm.Runtime.Set("__v", v)
+    r, err := vm.Runtime.RunString("JSON.stringify(__v)")
+    if err != nil {
+        t.Fatal(err)
+    }
+    return r.String()
+}
+
+func TestRedisValue(t *testing.T) {
+    vm := &GojaVM{Runtime: goja.New()}
+
+    var m codecs.IMData = codecs.IMMap{"a": int64(1)}
+    err, blob := codecs.CodecIMv2.Encoder.Encode(&m)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cases := []struct {
+        name   string
+        reply  interface{}
+        decode bool
+        want   string
+    }{
+        {"integer", int64(42), false, "42"},
+        {"nil", nil, false, "null"},
+        {"bulk", []byte("abc"), false, `"abc"`},
+        {"mixed array", []interface{}{int64(1), nil, []byte("x"), []interface{}{[]byte("y")}}, false, `[1,null,"x",["y"]]`},
+        {"imv2 without decode", blob, false, redisJSON(t, vm, vm.Runtime.ToValue(string(blob)))},
+        {"imv2 with decode", blob, true, `{"a":1}`},
+        {"non imv2 with decode", []byte("abc"), true, `"abc"`},
+    }
+    for _, c := range cases {
+        got := redisJSON(t, vm, redisValue(vm, c.reply, c.decode))
+        if got != c.want {
+            t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+        }
+    }
+}
+
+func TestRedisDecodeOption(t *testing.T) {
+    vm := &GojaVM{Runtime: goja.New()}
+    for src, want := range map[string]bool{
+        "({decode: true})":  true,
+        "({decode: false})": false,
+        "({})":              false,
+        "undefined":         false,
+        "'decode'":          false,
+    } {
+        v, err := vm.Runtime.RunString(src)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := redisDecodeOption(v); got != want {
+            t.Errorf("%s: got %v, want %v", src, got, want)
+        }
+    }
+}
+
+func TestPipelineOk(t *testing.T) {
+    if !pipelineOk([]redisReply{{value: int64(1)}, {value: nil}}) {
+        t.Error("nil replies must not count as a failure")
+    }
+    if pipelineOk([]redisReply{{value: int64(1)}, {err: ErrorRedisSend}, {value: int64(2)}}) {
+        t.Error("a send error must count as a failure")
+    }
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+    "crypto/sha1"
+    "encoding/hex"
+    "errors"
+    "io/ioutil"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/packing/clove/storage"
+    "github.com/packing/clove/utils"
+    "github.com/packing/goja"
+)
+
+type redisScript struct {
+    name    string
+    source  string
+    sha     string
+    loaded  bool
+    checked time.Time
+}
+
+//EVALSHA得到空结果时, 每个脚本在此间隔内最多确认一次是否需要重新加载
+const redisScriptCheckInterval = time.Second
+
+var (
+    redisScriptsDir = ""
+
+    redisScriptsLock sync.RWMutex
+    redisScripts     = make(map[string]*redisScript)
+)
+
+//读取目录下的全部.lua文件, 文件名(不含扩展名)即redis.scripts下的函数名
+func loadRedisScripts(dir string) error {
+    if dir == "" {
+        return nil
+    }
+    files, err := filepath.Glob(filepath.Join(dir, "*.lua"))
+    if err != nil {
+        return err
+    }
+
+    scripts := make(map[string]*redisScript, len(files))
+    for _, f := range files {
+        bs, err := ioutil.ReadFile(f)
+        if err != nil {
+            return err
+        }
+        sum := sha1.Sum(bs)
+        name := strings.TrimSuffix(filepath.Base(f), ".lua")
+        scripts[name] = &redisScript{name: name, source: string(bs), sha: hex.EncodeToString(sum[:])}
+    }
+
+    //启动与重新加载时即执行SCRIPT LOAD, storage不可用时在首次调用时补加载
+    loaded := 0
+    if c := storageRawClient(); c != nil {
+        for _, sc := range scripts {
+            if sc.load(c) {
+                loaded++
+            } else {
+                utils.LogWarn(">>> redis脚本 %s 加载失败", sc.name)
+            }
+        }
+    }
+
+    redisScriptsLock.Lock()
+    redisScripts = scripts
+    redisScriptsLock.Unlock()
+
+    utils.LogInfo(">>> 已加载redis脚本 %d/%d 个 %s", loaded, len(scripts), dir)
+    return nil
+}
+
+func getRedisScript(name string) *redisScript {
+    redisScriptsLock.RLock()
+    defer redisScriptsLock.RUnlock()
+    return redisScripts[name]
+}
+
+func redisScriptNames() []string {
+    redisScriptsLock.RLock()
+    defer redisScriptsLock.RUnlock()
+    names := make([]string, 0, len(redisScripts))
+    for name := range redisScripts {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func (s *redisScript) load(c *storage.Client) bool {
+    sha := c.RedisDo("SCRIPT", "LOAD", s.source)
+    redisScriptsLock.Lock()
+    defer redisScriptsLock.Unlock()
+    s.loaded = sha != nil
+    return s.loaded
+}
+
+func (s *redisScript) isLoaded() bool {
+    redisScriptsLock.RLock()
+    defer redisScriptsLock.RUnlock()
+    return s.loaded
+}
+
+//需要在此时确认脚本是否仍在redis中
+func (s *redisScript) shouldCheck() bool {
+    redisScriptsLock.Lock()
+    defer redisScriptsLock.Unlock()
+    if time.Since(s.checked) < redisScriptCheckInterval {
+        return false
+    }
+    s.checked = time.Now()
+    return true
+}
+
+//storage对NOSCRIPT与脚本返回的nil都给出空结果. 脚本已在启动时加载, 只有redis重启或SCRIPT FLUSH后才会缺失,
+//因此空结果时按间隔限频地用SCRIPT EXISTS确认, 缺失则重新加载再执行一次; 限频窗口内的缺失会返回null
+func (s *redisScript) eval(c *storage.Client, args []interface{}) interface{} {
+    if !s.isLoaded() {
+        s.load(c)
+    }
+    evalArgs := append([]interface{}{s.sha}, args...)
+    rows := c.RedisDo("EVALSHA", evalArgs...)
+    if rows != nil || !s.shouldCheck() {
+        return rows
+    }
+
+    exists, _ := c.RedisDo("SCRIPT", "EXISTS", s.sha).([]interface{})
+    if len(exists) == 1 && toRedisInt(exists[0]) == 1 {
+        return rows
+    }
+    if !s.load(c) {
+        return nil
+    }
+    return c.RedisDo("EVALSHA", evalArgs...)
+}
+
+func toRedisInt(v interface{}) int64 {
+    switch n := v.(type) {
+    case int64:
+        return n
+    case int:
+        return int64(n)
+    case []byte:
+        if string(n) == "1" {
+            return 1
+        }
+    }
+    return 0
+}
+
+//redis.scripts.<name>(keys, args), 调用时按名称查找, 管理接口scripts.reload后使用最新的脚本内容
+func (n GojaVMNet) redisScriptFunc(name string) func(goja.FunctionCall) goja.Value {
+    return func(call goja.FunctionCall) goja.Value {
+        c := storageClient()
+        if c == nil {
+            panic(n.vm.Runtime.NewGoError(errors.New("redis is not available")))
+        }
+        s := getRedisScript(name)
+        if s == nil {
+            panic(n.vm.Runtime.NewGoError(errors.New("redis script " + name + " is not loaded")))
+        }
+
+        var keys, argv []goja.Value
+        if v := call.Argument(0); !goja.IsUndefined(v) && !goja.IsNull(v) {
+            if err := n.vm.Runtime.ExportTo(v, &keys); err != nil {
+                panic(n.vm.Runtime.NewTypeError("redis script keys must be an array"))
+            }
+        }
+        if v := call.Argument(1); !goja.IsUndefined(v) && !goja.IsNull(v) {
+            if err := n.vm.Runtime.ExportTo(v, &argv); err != nil {
+                panic(n.vm.Runtime.NewTypeError("redis script args must be an array"))
+            }
+        }
+
+        args := make([]interface{}, 0, len(keys)+len(argv)+1)
+        args = append(args, len(keys))
+        for _, k := range redisArgs(keys) {
+            if storageNamespace != "" {
+                k = prefixRedisKey(k)
+            }
+            args = append(args, k)
+        }
+        args = append(args, redisArgs(argv)...)
+        tb := time.Now()
+        rows := s.eval(c, args)
+        n.observeStorage("redis", "scripts."+name, args, tb)
+        return redisValue(n.vm, rows, redisDecodeOption(call.Argument(2)))
+    }
+}
+
+func (n GojaVMNet) redisScriptsObject() *goja.Object {
+    o := n.vm.Runtime.NewObject()
+    for _, name := range redisScriptNames() {
+        o.Set(name, n.redisScriptFunc(name))
+    }
+    return o
+}
+
+//redis.scripts为访问器属性, 每次读取时按当前的脚本列表生成, VM创建之后经scripts.reload新增的脚本同样可见
+func (n GojaVMNet) defineRedisScripts(objRedis *goja.Object) {
+    getter := n.vm.Runtime.ToValue(func(call goja.FunctionCall) goja.Value {
+        return n.redisScriptsObject()
+    })
+    objRedis.DefineAccessorProperty("scripts", getter, nil, goja.FLAG_FALSE, goja.FLAG_TRUE)
+}
+
+func init() {
+    registerAdminCommand("scripts.reload", func(args interface{}) (interface{}, error) {
+        if err := loadRedisScripts(redisScriptsDir); err != nil {
+            return nil, err
+        }
+        return redisScriptNames(), nil
+    })
+}
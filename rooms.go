@@ -0,0 +1,230 @@
+package main
+
+import (
+    "sort"
+    "sync"
+
+    "github.com/packing/clove/messages"
+    "github.com/packing/clove/nnet"
+    "github.com/packing/goja"
+)
+
+type Room struct {
+    name    string
+    members map[nnet.SessionID]struct{}
+}
+
+var (
+    roomsLock      sync.RWMutex
+    rooms          = make(map[string]*Room)
+    roomsOfSession = make(map[nnet.SessionID]map[string]struct{})
+)
+
+func createRoom(name string) bool {
+    roomsLock.Lock()
+    defer roomsLock.Unlock()
+    if _, ok := rooms[name]; ok {
+        return false
+    }
+    rooms[name] = &Room{name: name, members: make(map[nnet.SessionID]struct{})}
+    return true
+}
+
+func destroyRoom(name string) bool {
+    roomsLock.Lock()
+    defer roomsLock.Unlock()
+    room, ok := rooms[name]
+    if !ok {
+        return false
+    }
+    for sid := range room.members {
+        delete(roomsOfSession[sid], name)
+        if len(roomsOfSession[sid]) == 0 {
+            delete(roomsOfSession, sid)
+        }
+    }
+    delete(rooms, name)
+    return true
+}
+
+//房间不存在时自动创建
+func joinRoom(name string, sid nnet.SessionID) bool {
+    roomsLock.Lock()
+    defer roomsLock.Unlock()
+    room, ok := rooms[name]
+    if !ok {
+        room = &Room{name: name, members: make(map[nnet.SessionID]struct{})}
+        rooms[name] = room
+    }
+    if _, ok := room.members[sid]; ok {
+        return false
+    }
+    room.members[sid] = struct{}{}
+    joined, ok := roomsOfSession[sid]
+    if !ok {
+        joined = make(map[string]struct{})
+        roomsOfSession[sid] = joined
+    }
+    joined[name] = struct{}{}
+    return true
+}
+
+func leaveRoom(name string, sid nnet.SessionID) bool {
+    roomsLock.Lock()
+    defer roomsLock.Unlock()
+    room, ok := rooms[name]
+    if !ok {
+        return false
+    }
+    if _, ok := room.members[sid]; !ok {
+        return false
+    }
+    delete(room.members, sid)
+    delete(roomsOfSession[sid], name)
+    if len(roomsOfSession[sid]) == 0 {
+        delete(roomsOfSession, sid)
+    }
+    return true
+}
+
+//客户端断开时由OnDeliver调用, 将其从所有房间移除
+func leaveAllRooms(sid nnet.SessionID) {
+    roomsLock.Lock()
+    defer roomsLock.Unlock()
+    for name := range roomsOfSession[sid] {
+        if room, ok := rooms[name]; ok {
+            delete(room.members, sid)
+        }
+    }
+    delete(roomsOfSession, sid)
+}
+
+func roomMembers(name string, except nnet.SessionID) []nnet.SessionID {
+    roomsLock.RLock()
+    defer roomsLock.RUnlock()
+    room, ok := rooms[name]
+    if !ok {
+        return nil
+    }
+    sids := make([]nnet.SessionID, 0, len(room.members))
+    for sid := range room.members {
+        if sid != except {
+            sids = append(sids, sid)
+        }
+    }
+    sort.Slice(sids, func(i, j int) bool { return sids[i] < sids[j] })
+    return sids
+}
+
+func roomNames() []string {
+    roomsLock.RLock()
+    defer roomsLock.RUnlock()
+    names := make([]string, 0, len(rooms))
+    for name := range rooms {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func roomsOf(sid nnet.SessionID) []string {
+    roomsLock.RLock()
+    defer roomsLock.RUnlock()
+    names := make([]string, 0, len(roomsOfSession[sid]))
+    for name := range roomsOfSession[sid] {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func (n GojaVMNet) sessionArg(call goja.FunctionCall, idx int) nnet.SessionID {
+    if len(call.Arguments) > idx && !goja.IsUndefined(call.Arguments[idx]) && !goja.IsNull(call.Arguments[idx]) {
+        return nnet.SessionID(call.Arguments[idx].ToInteger())
+    }
+    return n.vm.associatedSessionId
+}
+
+func (n GojaVMNet) RoomCreate(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 {
+        return n.vm.Runtime.ToValue(false)
+    }
+    return n.vm.Runtime.ToValue(createRoom(call.Arguments[0].String()))
+}
+
+func (n GojaVMNet) RoomDestroy(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 {
+        return n.vm.Runtime.ToValue(false)
+    }
+    return n.vm.Runtime.ToValue(destroyRoom(call.Arguments[0].String()))
+}
+
+func (n GojaVMNet) RoomJoin(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 {
+        return n.vm.Runtime.ToValue(false)
+    }
+    sid := n.sessionArg(call, 1)
+    if sid == 0 {
+        return n.vm.Runtime.ToValue(false)
+    }
+    return n.vm.Runtime.ToValue(joinRoom(call.Arguments[0].String(), sid))
+}
+
+func (n GojaVMNet) RoomLeave(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 {
+        return n.vm.Runtime.ToValue(false)
+    }
+    return n.vm.Runtime.ToValue(leaveRoom(call.Arguments[0].String(), n.sessionArg(call, 1)))
+}
+
+func (n GojaVMNet) RoomMembers(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 {
+        return goja.Null()
+    }
+    sids := roomMembers(call.Arguments[0].String(), 0)
+    if sids == nil {
+        return goja.Null()
+    }
+    return n.vm.Runtime.ToValue(sids)
+}
+
+func (n GojaVMNet) RoomList(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) > 0 && !goja.IsUndefined(call.Arguments[0]) && !goja.IsNull(call.Arguments[0]) {
+        return n.vm.Runtime.ToValue(roomsOf(nnet.SessionID(call.Arguments[0].ToInteger())))
+    }
+    return n.vm.Runtime.ToValue(roomNames())
+}
+
+func (n GojaVMNet) RoomBroadcast(call goja.FunctionCall) goja.Value {
+    if OnGojaSendMessageTo == nil {
+        return n.vm.Runtime.ToValue(-1)
+    }
+    if len(call.Arguments) < 2 {
+        return n.vm.Runtime.ToValue(-1)
+    }
+    if goja.IsUndefined(call.Arguments[1]) || goja.IsNull(call.Arguments[1]) {
+        return n.vm.Runtime.ToValue(-1)
+    }
+
+    m, ok := call.Arguments[1].Export().(map[string]interface{})
+    if !ok {
+        return n.vm.Runtime.ToValue(-1)
+    }
+
+    except := nnet.SessionID(0)
+    if len(call.Arguments) > 2 && !goja.IsUndefined(call.Arguments[2]) && !goja.IsNull(call.Arguments[2]) {
+        except = nnet.SessionID(call.Arguments[2].ToInteger())
+    }
+
+    sids := roomMembers(call.Arguments[0].String(), except)
+    if len(sids) == 0 {
+        return n.vm.Runtime.ToValue(0)
+    }
+
+    sm := transferGojaMap2GoMap(m)
+    sm[int64(messages.ProtocolKeySessionId)] = sids
+
+    OnGojaSendMessageTo(sm)
+
+    return n.vm.Runtime.ToValue(len(sids))
+}
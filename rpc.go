@@ -0,0 +1,214 @@
+package main
+
+import (
+    "errors"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/packing/clove/codecs"
+    "github.com/packing/clove/messages"
+    "github.com/packing/clove/nnet"
+    "github.com/packing/clove/utils"
+    "github.com/packing/goja"
+)
+
+//经由master转发的slave间调用, 不与clove内置的消息类型冲突
+const (
+    ProtocolTypeSlaveRPC       = 0x40
+    ProtocolTypeSlaveRPCReturn = 0x41
+)
+
+const (
+    RPCErrorCodeScript   = 1
+    RPCErrorCodeNoVM     = 2
+    RPCErrorCodeNoHandle = 3
+)
+
+var (
+    rpcSerial  int64
+    rpcWaiters sync.Map
+
+    //master在slave hello的应答中分配的slave id, 未分配前无法发起或应答rpc
+    slaveId int64
+
+    //rpc.call会占住当前上下文等待结果, 等待时间不超过单次派发的预算
+    rpcMaxTimeout = 3 * time.Second
+
+    ErrorRPCTimeout   = errors.New("rpc timeout")
+    ErrorRPCNoSlaveId = errors.New("rpc is not available before the master assigns a slave id")
+)
+
+//master对slave hello的应答, ProtocolKeyId为分配给本slave的id
+func OnSlaveHello(msg *messages.Message) error {
+    body := msg.GetBody()
+    if body == nil {
+        return nil
+    }
+    id := codecs.CreateMapReader(body).IntValueOf(messages.ProtocolKeyId, 0)
+    if id > 0 {
+        atomic.StoreInt64(&slaveId, id)
+        utils.LogInfo(">>> master分配的slave id: %d", id)
+    }
+    return nil
+}
+
+func sendRPCReturn(serial int64, caller int64, errCode int, result interface{}) {
+    msg := messages.CreateS2SMessage(ProtocolTypeSlaveRPCReturn)
+    msg.SetTag(messages.ProtocolTagSlave)
+    msg.SetSearial(serial)
+    msg.SetErrorCode(errCode)
+    body := codecs.IMMap{}
+    body[messages.ProtocolKeyId] = atomic.LoadInt64(&slaveId)
+    body[messages.ProtocolKeyValue] = caller
+    body[messages.ProtocolKeyResult] = result
+    msg.SetBody(body)
+    pck, err := messages.DataFromMessage(msg)
+    if err == nil {
+        tcpCtrl.Send(pck)
+    }
+}
+
+//收到其他slave的调用请求, 借用脚本上下文执行__rpc__
+func OnRPC(msg *messages.Message) error {
+    defer func() {
+        utils.LogPanic(recover())
+    }()
+
+    body := msg.GetBody()
+    if body == nil {
+        return nil
+    }
+    r := codecs.CreateMapReader(body)
+    caller := r.IntValueOf(messages.ProtocolKeyId, 0)
+    method := r.StrValueOf(messages.ProtocolKeyCmd, "")
+    args := r.TryReadValue(messages.ProtocolKeyArgs)
+
+    vm := borrowGojaVM()
+    if vm == nil {
+        sendRPCReturn(msg.GetSearial(), caller, RPCErrorCodeNoVM, "script engine is not available")
+        return nil
+    }
+    defer returnGojaVM(vm)
+
+    sids := msg.GetSessionId()
+    if len(sids) > 0 {
+        vm.SetValue("CurrentSessionId", sids[0])
+        vm.SetAssociatedSessionId(sids[0])
+    }
+
+    result, code, err := vm.DispatchRPC(method, args, caller)
+    if err != nil {
+        sendRPCReturn(msg.GetSearial(), caller, code, err.Error())
+        return nil
+    }
+    sendRPCReturn(msg.GetSearial(), caller, 0, result)
+    return nil
+}
+
+func OnRPCReturn(msg *messages.Message) error {
+    w, ok := rpcWaiters.Load(msg.GetSearial())
+    if !ok {
+        return nil
+    }
+    ch, ok := w.(chan *messages.Message)
+    if ok {
+        select {
+        case ch <- msg:
+        default:
+        }
+    }
+    return nil
+}
+
+//rpc.call(target, method, args, timeout)
+//target为数字时视为会话ID, 由master路由到该会话所在的slave; {slave: id}则直接指定slave
+func (n GojaVMNet) RPCCall(call goja.FunctionCall) goja.Value {
+    if tcpCtrl == nil {
+        panic(n.vm.Runtime.NewGoError(errors.New("rpc is not available")))
+    }
+    if len(call.Arguments) < 2 {
+        panic(n.vm.Runtime.NewTypeError("rpc.call requires target and method"))
+    }
+    id := atomic.LoadInt64(&slaveId)
+    if id == 0 {
+        panic(n.vm.Runtime.NewGoError(ErrorRPCNoSlaveId))
+    }
+
+    msg := messages.CreateS2SMessage(ProtocolTypeSlaveRPC)
+    msg.SetTag(messages.ProtocolTagSlave)
+
+    body := codecs.IMMap{}
+    body[messages.ProtocolKeyId] = id
+    body[messages.ProtocolKeyCmd] = call.Arguments[1].String()
+
+    target := call.Arguments[0]
+    if obj, ok := target.(*goja.Object); ok {
+        if v := obj.Get("slave"); v != nil && !goja.IsUndefined(v) && !goja.IsNull(v) {
+            body[messages.ProtocolKeyValue] = v.ToInteger()
+        }
+        if v := obj.Get("session"); v != nil && !goja.IsUndefined(v) && !goja.IsNull(v) {
+            msg.SetSessionId([]nnet.SessionID{nnet.SessionID(v.ToInteger())})
+        }
+    } else {
+        msg.SetSessionId([]nnet.SessionID{nnet.SessionID(target.ToInteger())})
+    }
+
+    if len(call.Arguments) > 2 && !goja.IsUndefined(call.Arguments[2]) && !goja.IsNull(call.Arguments[2]) {
+        switch v := call.Arguments[2].Export().(type) {
+        case map[string]interface{}:
+            body[messages.ProtocolKeyArgs] = transferGojaMap2GoMap(v)
+        case []interface{}:
+            body[messages.ProtocolKeyArgs] = transferGojaArray2GoArray(v)
+        default:
+            body[messages.ProtocolKeyArgs] = v
+        }
+    }
+
+    timeout := rpcMaxTimeout
+    if len(call.Arguments) > 3 && !goja.IsUndefined(call.Arguments[3]) && !goja.IsNull(call.Arguments[3]) {
+        if t := time.Duration(call.Arguments[3].ToInteger()) * time.Millisecond; t > 0 && t < timeout {
+            timeout = t
+        }
+    }
+
+    serial := atomic.AddInt64(&rpcSerial, 1)
+    msg.SetSearial(serial)
+    msg.SetBody(body)
+
+    ch := make(chan *messages.Message, 1)
+    rpcWaiters.Store(serial, ch)
+    defer rpcWaiters.Delete(serial)
+
+    pck, err := messages.DataFromMessage(msg)
+    if err != nil {
+        panic(n.vm.Runtime.NewGoError(err))
+    }
+    tcpCtrl.Send(pck)
+
+    tr := time.NewTimer(timeout)
+    defer tr.Stop()
+
+    select {
+    case ret := <-ch:
+        r := codecs.CreateMapReader(ret.GetBody())
+        result := r.TryReadValue(messages.ProtocolKeyResult)
+        if ret.GetErrorCode() != 0 {
+            e := n.vm.Runtime.NewGoError(errors.New(r.StrValueOf(messages.ProtocolKeyResult, "rpc error")))
+            e.Set("code", ret.GetErrorCode())
+            panic(e)
+        }
+        switch v := result.(type) {
+        case map[interface{}]interface{}:
+            return n.vm.Runtime.ToValue(transferGoMap2GojaMap(v))
+        case []interface{}:
+            return n.vm.Runtime.ToValue(transferGoArray2GojaArray(v))
+        }
+        return n.vm.Runtime.ToValue(result)
+    case <-tr.C:
+        stacks := make([]goja.StackFrame, 5)
+        errStr := GenGojaStackFrameString(n.vm, "[J] !!! rpc.call timeout "+call.Arguments[1].String(), n.vm.Runtime.CaptureCallStack(5, stacks))
+        utils.LogError(errStr)
+        panic(n.vm.Runtime.NewGoError(ErrorRPCTimeout))
+    }
+}
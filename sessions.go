@@ -0,0 +1,165 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/packing/clove/nnet"
+    "github.com/packing/goja"
+)
+
+type SessionInfo struct {
+    Id         nnet.SessionID `json:"id,string"`
+    Host       string         `json:"host"`
+    EnterTime  int64          `json:"enterTime"`
+    SourceId   uint64         `json:"sourceId"`
+    SourceAddr string         `json:"sourceAddr"`
+    LastActive int64          `json:"lastActive"`
+    Messages   uint64         `json:"messages"`
+}
+
+var (
+    sessionsLock sync.RWMutex
+    sessions     = make(map[nnet.SessionID]*SessionInfo)
+
+    //被踢下线的会话及原因, 在ClientLeave时传给__leave__
+    kickReasons = make(map[nnet.SessionID]int64)
+)
+
+func nowMillis() int64 {
+    return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func enterSession(sid nnet.SessionID, host string, sourceId uint64, sourceAddr string) {
+    now := nowMillis()
+    sessionsLock.Lock()
+    defer sessionsLock.Unlock()
+    sessions[sid] = &SessionInfo{
+        Id:         sid,
+        Host:       host,
+        EnterTime:  now,
+        SourceId:   sourceId,
+        SourceAddr: sourceAddr,
+        LastActive: now,
+    }
+}
+
+func leaveSession(sid nnet.SessionID) {
+    sessionsLock.Lock()
+    defer sessionsLock.Unlock()
+    delete(sessions, sid)
+    delete(kickReasons, sid)
+}
+
+func markSessionKicked(sid nnet.SessionID, reason int64) {
+    sessionsLock.Lock()
+    defer sessionsLock.Unlock()
+    if _, ok := sessions[sid]; ok {
+        kickReasons[sid] = reason
+    }
+}
+
+func sessionKickReason(sid nnet.SessionID) int64 {
+    sessionsLock.RLock()
+    defer sessionsLock.RUnlock()
+    return kickReasons[sid]
+}
+
+func touchSession(sid nnet.SessionID) {
+    sessionsLock.RLock()
+    info, ok := sessions[sid]
+    sessionsLock.RUnlock()
+    if ok {
+        atomic.StoreInt64(&info.LastActive, nowMillis())
+        atomic.AddUint64(&info.Messages, 1)
+    }
+}
+
+func getSessionInfo(sid nnet.SessionID) (SessionInfo, bool) {
+    sessionsLock.RLock()
+    defer sessionsLock.RUnlock()
+    info, ok := sessions[sid]
+    if !ok {
+        return SessionInfo{}, false
+    }
+    return SessionInfo{
+        Id:         info.Id,
+        Host:       info.Host,
+        EnterTime:  info.EnterTime,
+        SourceId:   info.SourceId,
+        SourceAddr: info.SourceAddr,
+        LastActive: atomic.LoadInt64(&info.LastActive),
+        Messages:   atomic.LoadUint64(&info.Messages),
+    }, true
+}
+
+func sessionIds() []nnet.SessionID {
+    sessionsLock.RLock()
+    defer sessionsLock.RUnlock()
+    sids := make([]nnet.SessionID, 0, len(sessions))
+    for sid := range sessions {
+        sids = append(sids, sid)
+    }
+    sort.Slice(sids, func(i, j int) bool { return sids[i] < sids[j] })
+    return sids
+}
+
+func sessionCount() int {
+    sessionsLock.RLock()
+    defer sessionsLock.RUnlock()
+    return len(sessions)
+}
+
+func (n GojaVMNet) Sessions(call goja.FunctionCall) goja.Value {
+    return n.vm.Runtime.ToValue(sessionIds())
+}
+
+func (n GojaVMNet) SessionInfo(call goja.FunctionCall) goja.Value {
+    info, ok := getSessionInfo(n.sessionArg(call, 0))
+    if !ok {
+        return goja.Null()
+    }
+    o := n.vm.Runtime.NewObject()
+    o.Set("id", info.Id)
+    o.Set("host", info.Host)
+    o.Set("enterTime", info.EnterTime)
+    o.Set("sourceId", info.SourceId)
+    o.Set("sourceAddr", info.SourceAddr)
+    o.Set("lastActive", info.LastActive)
+    o.Set("messages", info.Messages)
+    return o
+}
+
+func init() {
+    registerAdminCommand("sessions", func(args interface{}) (interface{}, error) {
+        sids := sessionIds()
+        infos := make([]SessionInfo, 0, len(sids))
+        for _, sid := range sids {
+            if info, ok := getSessionInfo(sid); ok {
+                infos = append(infos, info)
+            }
+        }
+        return infos, nil
+    })
+    registerAdminCommand("session", func(args interface{}) (interface{}, error) {
+        //会话id可能超过2^53, 以数字传入时json解码会丢失精度, 因此必须以字符串传入
+        v, ok := args.(string)
+        if !ok {
+            return nil, errors.New("session id must be a string")
+        }
+        sid, err := strconv.ParseUint(v, 10, 64)
+        if err != nil {
+            return nil, fmt.Errorf("invalid session id %q", v)
+        }
+        info, ok := getSessionInfo(sid)
+        if !ok {
+            return nil, nil
+        }
+        return info, nil
+    })
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/packing/clove/utils"
+    "github.com/packing/goja"
+)
+
+const (
+    SlowLogArgsRedact = "redact"
+    SlowLogArgsShow   = "show"
+    SlowLogArgsType   = "type"
+
+    //按语句聚合的统计数量上限, 超出后只计入汇总
+    storageStatsMaxStatements = 1024
+    slowLogMaxArgLen          = 64
+)
+
+type StorageStat struct {
+    Kind  string       `json:"kind"`
+    Slow  uint64       `json:"slow"`
+    Calls DurationStat `json:"calls"`
+}
+
+var (
+    slowLogThreshold = 100 * time.Millisecond
+    slowLogArgs      = SlowLogArgsRedact
+
+    storageStatsLock  sync.Mutex
+    storageStats      = make(map[string]*StorageStat)
+    storageStatsTotal = make(map[string]*StorageStat)
+)
+
+func updateStorageStat(m map[string]*StorageStat, key string, kind string, d time.Duration, slow bool) {
+    st, ok := m[key]
+    if !ok {
+        if len(m) >= storageStatsMaxStatements {
+            return
+        }
+        st = &StorageStat{Kind: kind}
+        m[key] = st
+    }
+    st.Calls.Add(d)
+    if slow {
+        st.Slow++
+    }
+}
+
+//redact时参数只输出个数, type时输出类型, show时输出截断后的值
+func formatSlowLogArgs(args []interface{}) string {
+    switch slowLogArgs {
+    case SlowLogArgsShow:
+        var b bytes.Buffer
+        for i, a := range args {
+            if i > 0 {
+                b.WriteString(", ")
+            }
+            var s string
+            if bs, ok := a.([]byte); ok {
+                s = fmt.Sprintf("<%d bytes>", len(bs))
+            } else {
+                s = fmt.Sprint(a)
+            }
+            if len(s) > slowLogMaxArgLen {
+                s = s[:slowLogMaxArgLen] + "..."
+            }
+            b.WriteString(s)
+        }
+        return b.String()
+    case SlowLogArgsType:
+        var b bytes.Buffer
+        for i, a := range args {
+            if i > 0 {
+                b.WriteString(", ")
+            }
+            fmt.Fprintf(&b, "%T", a)
+        }
+        return b.String()
+    }
+    return fmt.Sprintf("<%d args>", len(args))
+}
+
+//记录脚本发起的storage调用耗时, 超过阈值时连同会话与脚本位置写入慢日志
+func (n GojaVMNet) observeStorage(kind string, stmt string, args []interface{}, tb time.Time) {
+    if name := n.backendName(); name != "" {
+        kind += "@" + name
+    }
+    d := time.Since(tb)
+    slow := slowLogThreshold > 0 && d >= slowLogThreshold
+
+    storageStatsLock.Lock()
+    updateStorageStat(storageStats, kind+" "+stmt, kind, d, slow)
+    updateStorageStat(storageStatsTotal, kind, kind, d, slow)
+    storageStatsLock.Unlock()
+
+    if !slow {
+        return
+    }
+    stacks := make([]goja.StackFrame, 5)
+    title := fmt.Sprintf("[J] !!! slow %s session=%d cost=%s %s [%s]", kind, n.vm.associatedSessionId, d, stmt, formatSlowLogArgs(args))
+    utils.LogWarn("%s", GenGojaStackFrameString(n.vm, title, n.vm.Runtime.CaptureCallStack(5, stacks)))
+}
+
+func init() {
+    registerMetrics("storage", func() interface{} {
+        storageStatsLock.Lock()
+        defer storageStatsLock.Unlock()
+        statements := make(map[string]StorageStat, len(storageStats))
+        for k, st := range storageStats {
+            statements[k] = *st
+        }
+        total := make(map[string]StorageStat, len(storageStatsTotal))
+        for k, st := range storageStatsTotal {
+            total[k] = *st
+        }
+        return map[string]interface{}{
+            "total":      total,
+            "statements": statements,
+        }
+    })
+}
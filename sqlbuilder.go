@@ -0,0 +1,299 @@
+package main
+
+import (
+    "fmt"
+    "regexp"
+    "strings"
+
+    "github.com/packing/goja"
+)
+
+//表名与列名只允许标识符, 可带一级库名; 值一律以?传参
+var sqlIdentPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func quoteIdent(name string) (string, error) {
+    if !sqlIdentPattern.MatchString(name) {
+        return "", fmt.Errorf("invalid sql identifier %q", name)
+    }
+    return "`" + strings.Replace(name, ".", "`.`", 1) + "`", nil
+}
+
+type sqlBuilder struct {
+    n    GojaVMNet
+    b    strings.Builder
+    args []interface{}
+}
+
+func (s *sqlBuilder) ident(name string) {
+    q, err := quoteIdent(name)
+    if err != nil {
+        panic(s.n.vm.Runtime.NewTypeError(err.Error()))
+    }
+    s.b.WriteString(q)
+}
+
+func (s *sqlBuilder) object(v goja.Value, what string) *goja.Object {
+    if !isPlainObject(v) {
+        panic(s.n.vm.Runtime.NewTypeError(what + " must be an object"))
+    }
+    return v.(*goja.Object)
+}
+
+//{col: v} 为等值条件, null为IS NULL, 数组为IN; 多个条件以AND连接.
+//undefined多半是拼错了字段名, 直接报错, 避免按IS NULL匹配到意外的行
+func (s *sqlBuilder) where(v goja.Value, required bool) {
+    if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+        if required {
+            panic(s.n.vm.Runtime.NewTypeError("where condition is required"))
+        }
+        return
+    }
+    obj := s.object(v, "where")
+    keys := obj.Keys()
+    if len(keys) == 0 {
+        if required {
+            panic(s.n.vm.Runtime.NewTypeError("where condition is required"))
+        }
+        return
+    }
+
+    s.b.WriteString(" WHERE ")
+    for i, k := range keys {
+        if i > 0 {
+            s.b.WriteString(" AND ")
+        }
+        s.ident(k)
+        val := obj.Get(k)
+        if val == nil || goja.IsUndefined(val) {
+            panic(s.n.vm.Runtime.NewTypeError("where condition " + k + " is undefined"))
+        }
+        if goja.IsNull(val) {
+            s.b.WriteString(" IS NULL")
+            continue
+        }
+        if o, ok := val.(*goja.Object); ok && o.ClassName() == "Array" {
+            var list []goja.Value
+            s.n.vm.Runtime.ExportTo(o, &list)
+            if len(list) == 0 {
+                s.b.WriteString(" IN (NULL) AND 1=0")
+                continue
+            }
+            s.b.WriteString(" IN (")
+            for j, item := range list {
+                if j > 0 {
+                    s.b.WriteString(", ")
+                }
+                s.b.WriteByte('?')
+                s.args = append(s.args, s.n.mysqlArg(item))
+            }
+            s.b.WriteByte(')')
+            continue
+        }
+        s.b.WriteString(" = ?")
+        s.args = append(s.args, s.n.mysqlArg(val))
+    }
+}
+
+//按第一行的列生成多行插入, 其余行缺少的列以NULL写入
+func (s *sqlBuilder) insert(verb string, table string, rows goja.Value) []string {
+    var list []goja.Value
+    if o, ok := rows.(*goja.Object); ok && o.ClassName() == "Array" {
+        s.n.vm.Runtime.ExportTo(o, &list)
+    } else {
+        list = []goja.Value{rows}
+    }
+    if len(list) == 0 {
+        panic(s.n.vm.Runtime.NewTypeError("insert requires at least one row"))
+    }
+    cols := s.object(list[0], "row").Keys()
+    if len(cols) == 0 {
+        panic(s.n.vm.Runtime.NewTypeError("insert requires at least one column"))
+    }
+
+    s.b.WriteString(verb)
+    s.b.WriteString(" INTO ")
+    s.ident(table)
+    s.b.WriteString(" (")
+    for i, c := range cols {
+        if i > 0 {
+            s.b.WriteString(", ")
+        }
+        s.ident(c)
+    }
+    s.b.WriteString(") VALUES ")
+    for i, r := range list {
+        obj := s.object(r, "row")
+        if i > 0 {
+            s.b.WriteString(", ")
+        }
+        s.b.WriteByte('(')
+        for j, c := range cols {
+            if j > 0 {
+                s.b.WriteString(", ")
+            }
+            s.b.WriteByte('?')
+            s.args = append(s.args, s.n.mysqlArg(obj.Get(c)))
+        }
+        s.b.WriteByte(')')
+    }
+    return cols
+}
+
+func (n GojaVMNet) checkBuilder(call goja.FunctionCall, op string, argc int) bool {
+    if n.storageBackend().Unavailable() {
+        n.throwStorageError("mysql."+op, ErrorStorageUnavailable)
+        return false
+    }
+    if len(call.Arguments) < argc {
+        panic(n.vm.Runtime.NewTypeError(fmt.Sprintf("mysql.%s requires %d arguments", op, argc)))
+    }
+    return true
+}
+
+//mysql.insert(table, row | [rows])
+func (n GojaVMNet) Insert(call goja.FunctionCall) goja.Value {
+    if !n.checkBuilder(call, "insert", 2) {
+        return n.vm.Runtime.ToValue(0)
+    }
+    s := &sqlBuilder{n: n}
+    s.insert("INSERT", call.Arguments[0].String(), call.Arguments[1])
+    return n.runExec(s.b.String(), s.args)
+}
+
+//mysql.upsert(table, row | [rows], [updateColumns]) 主键或唯一键冲突时更新指定列, 默认更新全部列
+func (n GojaVMNet) Upsert(call goja.FunctionCall) goja.Value {
+    if !n.checkBuilder(call, "upsert", 2) {
+        return n.vm.Runtime.ToValue(0)
+    }
+    s := &sqlBuilder{n: n}
+    cols := s.insert("INSERT", call.Arguments[0].String(), call.Arguments[1])
+    if v := call.Argument(2); !goja.IsUndefined(v) && !goja.IsNull(v) {
+        var list []string
+        if err := n.vm.Runtime.ExportTo(v, &list); err != nil || len(list) == 0 {
+            panic(n.vm.Runtime.NewTypeError("upsert update columns must be a non-empty array"))
+        }
+        cols = list
+    }
+    s.b.WriteString(" ON DUPLICATE KEY UPDATE ")
+    for i, c := range cols {
+        if i > 0 {
+            s.b.WriteString(", ")
+        }
+        s.ident(c)
+        s.b.WriteString(" = VALUES(")
+        s.ident(c)
+        s.b.WriteByte(')')
+    }
+    return n.runExec(s.b.String(), s.args)
+}
+
+//mysql.update(table, set, where) where不能为空, 避免误更新整张表
+func (n GojaVMNet) Update(call goja.FunctionCall) goja.Value {
+    if !n.checkBuilder(call, "update", 3) {
+        return n.vm.Runtime.ToValue(0)
+    }
+    s := &sqlBuilder{n: n}
+    set := s.object(call.Arguments[1], "set")
+    cols := set.Keys()
+    if len(cols) == 0 {
+        panic(n.vm.Runtime.NewTypeError("update requires at least one column"))
+    }
+
+    s.b.WriteString("UPDATE ")
+    s.ident(call.Arguments[0].String())
+    s.b.WriteString(" SET ")
+    for i, c := range cols {
+        if i > 0 {
+            s.b.WriteString(", ")
+        }
+        s.ident(c)
+        s.b.WriteString(" = ?")
+        s.args = append(s.args, n.mysqlArg(set.Get(c)))
+    }
+    s.where(call.Arguments[2], true)
+    return n.runExec(s.b.String(), s.args)
+}
+
+//mysql.select(table, where, {columns, order, limit, offset}) 其余选项(cache, types)与mysql.query相同
+func (n GojaVMNet) Select(call goja.FunctionCall) goja.Value {
+    if !n.checkBuilder(call, "select", 1) {
+        return goja.Null()
+    }
+    s := &sqlBuilder{n: n}
+    var opts *goja.Object
+    if v := call.Argument(2); isPlainObject(v) {
+        opts = v.(*goja.Object)
+    }
+
+    s.b.WriteString("SELECT ")
+    var cols []string
+    if opts != nil {
+        if v := opts.Get("columns"); v != nil && !goja.IsUndefined(v) && !goja.IsNull(v) {
+            if err := n.vm.Runtime.ExportTo(v, &cols); err != nil {
+                panic(n.vm.Runtime.NewTypeError("select columns must be an array"))
+            }
+        }
+    }
+    if len(cols) == 0 {
+        s.b.WriteByte('*')
+    }
+    for i, c := range cols {
+        if i > 0 {
+            s.b.WriteString(", ")
+        }
+        s.ident(c)
+    }
+    s.b.WriteString(" FROM ")
+    s.ident(call.Arguments[0].String())
+    s.where(call.Argument(1), false)
+
+    if opts != nil {
+        s.order(opts.Get("order"))
+        s.limit(opts.Get("limit"), opts.Get("offset"))
+    }
+    return n.runQuery(s.b.String(), s.args, opts)
+}
+
+//order为"col"、"-col"(降序)、"col desc"或它们组成的数组
+func (s *sqlBuilder) order(v goja.Value) {
+    if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+        return
+    }
+    var list []string
+    if err := s.n.vm.Runtime.ExportTo(v, &list); err != nil {
+        list = []string{v.String()}
+    }
+    for i, item := range list {
+        if i == 0 {
+            s.b.WriteString(" ORDER BY ")
+        } else {
+            s.b.WriteString(", ")
+        }
+        col, dir := strings.TrimSpace(item), "ASC"
+        if strings.HasPrefix(col, "-") {
+            col, dir = col[1:], "DESC"
+        } else if f := strings.Fields(col); len(f) == 2 {
+            switch strings.ToUpper(f[1]) {
+            case "ASC", "DESC":
+                col, dir = f[0], strings.ToUpper(f[1])
+            default:
+                panic(s.n.vm.Runtime.NewTypeError("invalid order direction " + f[1]))
+            }
+        }
+        s.ident(col)
+        s.b.WriteByte(' ')
+        s.b.WriteString(dir)
+    }
+}
+
+func (s *sqlBuilder) limit(limit goja.Value, offset goja.Value) {
+    if limit == nil || goja.IsUndefined(limit) || goja.IsNull(limit) {
+        return
+    }
+    s.b.WriteString(" LIMIT ?")
+    s.args = append(s.args, limit.ToInteger())
+    if offset != nil && !goja.IsUndefined(offset) && !goja.IsNull(offset) {
+        s.b.WriteString(" OFFSET ?")
+        s.args = append(s.args, offset.ToInteger())
+    }
+}
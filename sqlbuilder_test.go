@@ -0,0 +1,156 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/packing/clove/storage"
+    "github.com/packing/goja"
+)
+
+type sqlRecorder struct {
+    lock sync.Mutex
+    sql  string
+    args string
+}
+
+func (r *sqlRecorder) record(sql string, args []interface{}) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    r.sql, r.args = sql, fmt.Sprint(args)
+}
+
+func (r *sqlRecorder) last() (string, string) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    return r.sql, r.args
+}
+
+// 默认后端指向记录语句的假storage, 脚本中可直接调用insert/upsert/update/select
+func newSQLBuilderTestVM(t *testing.T) (*GojaVM, *sqlRecorder) {
+    rec := new(sqlRecorder)
+    sc, err := createSQLChannel("builder", newFakeSQLStorage(t, rec.record), time.Second, 65536)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defaultStorage.lock.Lock()
+    client, sql := defaultStorage.client, defaultStorage.sql
+    defaultStorage.client, defaultStorage.sql = new(storage.Client), sc
+    defaultStorage.lock.Unlock()
+    t.Cleanup(func() {
+        defaultStorage.lock.Lock()
+        defaultStorage.client, defaultStorage.sql = client, sql
+        defaultStorage.lock.Unlock()
+        sc.close()
+    })
+
+    vm := &GojaVM{Runtime: goja.New()}
+    vm.defineErrorTypes()
+    gn := GojaVMNet{vm: vm}
+    vm.Runtime.Set("insert", gn.Insert)
+    vm.Runtime.Set("upsert", gn.Upsert)
+    vm.Runtime.Set("update", gn.Update)
+    vm.Runtime.Set("select", gn.Select)
+    return vm, rec
+}
+
+func TestQuoteIdent(t *testing.T) {
+    for name, want := range map[string]string{
+        "users":      "`users`",
+        "game.users": "`game`.`users`",
+        "_t1":        "`_t1`",
+    } {
+        if got, err := quoteIdent(name); err != nil || got != want {
+            t.Errorf("%s: got %s %v, want %s", name, got, err, want)
+        }
+    }
+    for _, name := range []string{"", "1a", "a b", "a`b", "a'b", `a"b`, "a;b", "a.b.c", "a--", "a/*", "users;drop table x"} {
+        if got, err := quoteIdent(name); err == nil {
+            t.Errorf("%q: got %s, want an error", name, got)
+        }
+    }
+}
+
+func TestSQLBuilder(t *testing.T) {
+    vm, rec := newSQLBuilderTestVM(t)
+    cases := []struct {
+        src  string
+        sql  string
+        args string
+    }{
+        {
+            `insert("users", {id: 1, name: "a"})`,
+            "INSERT INTO `users` (`id`, `name`) VALUES (?, ?)",
+            "[1 a]",
+        },
+        {
+            `insert("game.users", [{id: 1, name: "a"}, {id: 2}])`,
+            "INSERT INTO `game`.`users` (`id`, `name`) VALUES (?, ?), (?, ?)",
+            "[1 a 2 <nil>]",
+        },
+        {
+            `upsert("users", {id: 1, n: 2}, ["n"])`,
+            "INSERT INTO `users` (`id`, `n`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `n` = VALUES(`n`)",
+            "[1 2]",
+        },
+        {
+            `upsert("users", {id: 1, n: 2})`,
+            "INSERT INTO `users` (`id`, `n`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `id` = VALUES(`id`), `n` = VALUES(`n`)",
+            "[1 2]",
+        },
+        {
+            `update("users", {n: 2, name: "b"}, {id: 1, deleted: null})`,
+            "UPDATE `users` SET `n` = ?, `name` = ? WHERE `id` = ? AND `deleted` IS NULL",
+            "[2 b 1]",
+        },
+        {
+            `select("users")`,
+            "SELECT * FROM `users`",
+            "[]",
+        },
+        {
+            `select("users", {id: [1, 2], role: [], name: "a"}, {columns: ["id", "name"], order: ["-id", "name asc"], limit: 10, offset: 5})`,
+            "SELECT `id`, `name` FROM `users` WHERE `id` IN (?, ?) AND `role` IN (NULL) AND 1=0 AND `name` = ? ORDER BY `id` DESC, `name` ASC LIMIT ? OFFSET ?",
+            "[1 2 a 10 5]",
+        },
+    }
+    for _, c := range cases {
+        if _, err := vm.Runtime.RunString(c.src); err != nil {
+            t.Errorf("%s: %v", c.src, err)
+            continue
+        }
+        sql, args := rec.last()
+        if sql != c.sql || args != c.args {
+            t.Errorf("%s:\n got %s %s\nwant %s %s", c.src, sql, args, c.sql, c.args)
+        }
+    }
+}
+
+func TestSQLBuilderRejects(t *testing.T) {
+    vm, rec := newSQLBuilderTestVM(t)
+    for src, want := range map[string]string{
+        "insert(\"users`; drop table x; --\", {id: 1})": "invalid sql identifier",
+        `insert("users", {"id = 1 or 1": 1})`:           "invalid sql identifier",
+        `insert("users", {"a b": 1})`:                   "invalid sql identifier",
+        `insert("users", {"a'b": 1})`:                   "invalid sql identifier",
+        `update("users", {n: 1}, {"id;": 1})`:           "invalid sql identifier",
+        `select("users", {}, {columns: ["*"]})`:         "invalid sql identifier",
+        `select("users", {}, {order: "id; drop"})`:      "invalid order direction",
+        `update("users", {n: 1}, {})`:                   "where condition is required",
+        `update("users", {n: 1}, null)`:                 "where condition is required",
+        `update("users", {n: 1}, {id: undefined})`:      "where condition id is undefined",
+        `select("users", {id: 1, name: undefined})`:     "where condition name is undefined",
+        `var w = {}; select("users", {id: w.idd})`:      "where condition id is undefined",
+    } {
+        _, err := vm.Runtime.RunString(src)
+        if err == nil || !strings.Contains(err.Error(), want) {
+            t.Errorf("%s: got %v, want %q", src, err, want)
+        }
+    }
+    if sql, _ := rec.last(); sql != "" {
+        t.Errorf("rejected statements must not reach storage, got %s", sql)
+    }
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/packing/clove/storage"
+    "github.com/packing/clove/utils"
+    "github.com/packing/goja"
+)
+
+type StorageBackend struct {
+    Name    string
+    Addr    string
+    Timeout time.Duration
+    Buffer  int
+
+    lock   sync.RWMutex
+    client *storage.Client
+    sql    *sqlChannel
+    health StorageHealth
+    downAt time.Time
+}
+
+var (
+    storageBackends = ""
+
+    defaultStorage = &StorageBackend{Name: "default", Buffer: 5242880}
+
+    //启动时创建, 运行期间只读
+    namedStorages = make(map[string]*StorageBackend)
+)
+
+//name=addr[;timeout=2s][;buffer=5242880], 多个以逗号分隔
+func parseStorageBackends(spec string) ([]*StorageBackend, error) {
+    var out []*StorageBackend
+    for _, item := range strings.Split(spec, ",") {
+        item = strings.TrimSpace(item)
+        if item == "" {
+            continue
+        }
+        parts := strings.Split(item, ";")
+        kv := strings.SplitN(parts[0], "=", 2)
+        if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+            return nil, fmt.Errorf("invalid storage backend %q", item)
+        }
+        b := &StorageBackend{Name: kv[0], Addr: kv[1], Timeout: storageTimeout, Buffer: 5242880}
+        for _, opt := range parts[1:] {
+            okv := strings.SplitN(opt, "=", 2)
+            if len(okv) != 2 {
+                return nil, fmt.Errorf("invalid storage backend option %q", opt)
+            }
+            switch okv[0] {
+            case "timeout":
+                d, err := time.ParseDuration(okv[1])
+                if err != nil {
+                    return nil, err
+                }
+                b.Timeout = d
+            case "buffer":
+                n, err := strconv.Atoi(okv[1])
+                if err != nil {
+                    return nil, err
+                }
+                b.Buffer = n
+            default:
+                return nil, fmt.Errorf("unknown storage backend option %q", okv[0])
+            }
+        }
+        out = append(out, b)
+    }
+    return out, nil
+}
+
+//tcp的storage启动时不可达也继续运行, 由健康检查负责重连
+func (b *StorageBackend) open() {
+    b.health.State = StorageStateUp
+    if !b.connect() {
+        b.setState(StorageStateDown)
+    }
+}
+
+func createDefaultStorage(addr string, timeout time.Duration) *storage.Client {
+    defaultStorage.Addr = addr
+    defaultStorage.Timeout = timeout
+    defaultStorage.open()
+    return defaultStorage.Client()
+}
+
+//storage客户端以进程号绑定unix管道, 每个进程只能有一个unix模式的客户端
+func createStorageBackends(spec string) error {
+    backends, err := parseStorageBackends(spec)
+    if err != nil {
+        return err
+    }
+    if err := checkUnixBackends(backends); err != nil {
+        return err
+    }
+    for _, b := range backends {
+        b.open()
+        namedStorages[b.Name] = b
+        utils.LogInfo(">>> 已创建storage后端 %s => %s", b.Name, b.Addr)
+    }
+    return nil
+}
+
+//包括默认后端在内最多只能有一个unix模式的后端
+func checkUnixBackends(backends []*StorageBackend) error {
+    unixBackend := ""
+    if !defaultStorage.isTCP() {
+        unixBackend = defaultStorage.Name
+    }
+    for _, b := range backends {
+        if b.isTCP() {
+            continue
+        }
+        if unixBackend != "" {
+            return fmt.Errorf("storage backend %s must use a tcp addr, %s already uses the unix socket", b.Name, unixBackend)
+        }
+        unixBackend = b.Name
+    }
+    return nil
+}
+
+func closeStorageBackends() {
+    for _, b := range namedStorages {
+        b.close()
+    }
+    defaultStorage.close()
+}
+
+//会话锁与会话级redis使用默认后端; 熔断期间返回nil
+func storageClient() *storage.Client {
+    return defaultStorage.Available()
+}
+
+//解锁、销毁锁键与关闭连接不经过熔断, 否则熔断期间这些资源会永久泄漏
+func storageRawClient() *storage.Client {
+    return defaultStorage.Client()
+}
+
+//未通过use选择后端时使用默认后端
+func (n GojaVMNet) storageBackend() *StorageBackend {
+    if n.backend != nil {
+        return n.backend
+    }
+    return defaultStorage
+}
+
+//熔断期间返回nil
+func (n GojaVMNet) storage() *storage.Client {
+    return n.storageBackend().Available()
+}
+
+//mysql查询与执行使用的通道, 熔断期间返回nil
+func (n GojaVMNet) sql() *sqlChannel {
+    b := n.storageBackend()
+    if b.Available() == nil {
+        return nil
+    }
+    return b.SQL()
+}
+
+func (n GojaVMNet) storageTimeout() time.Duration {
+    if n.backend != nil {
+        return n.backend.Timeout
+    }
+    return storageTimeout
+}
+
+func (n GojaVMNet) backendName() string {
+    if n.backend != nil {
+        return n.backend.Name
+    }
+    return ""
+}
+
+func (n GojaVMNet) useBackend(call goja.FunctionCall) GojaVMNet {
+    name := call.Argument(0).String()
+    b, ok := namedStorages[name]
+    if !ok {
+        panic(n.vm.Runtime.NewGoError(errors.New("storage backend " + name + " is not configured")))
+    }
+    return GojaVMNet{vm: n.vm, backend: b}
+}
+
+//mysql.use(name) 返回绑定到指定后端的mysql对象
+func (n GojaVMNet) UseMysql(call goja.FunctionCall) goja.Value {
+    gn := n.useBackend(call)
+    o := n.vm.Runtime.NewObject()
+    o.Set("query", gn.Query)
+    o.Set("exec", gn.Exec)
+    o.Set("insert", gn.Insert)
+    o.Set("update", gn.Update)
+    o.Set("select", gn.Select)
+    o.Set("upsert", gn.Upsert)
+    o.Set("invalidate", gn.Invalidate)
+    return o
+}
+
+//redis.use(name) 返回绑定到指定后端的redis对象, 会话级的open/send/flush/receive只在默认后端上提供
+func (n GojaVMNet) UseRedis(call goja.FunctionCall) goja.Value {
+    gn := n.useBackend(call)
+    o := n.vm.Runtime.NewObject()
+    o.Set("cmd", gn.Do)
+    o.Set("todo", gn.DoRaw)
+    o.Set("pipeline", gn.Pipeline)
+    o.Set("batch", gn.Batch)
+    o.Set("connect", gn.Connect)
+    return o
+}
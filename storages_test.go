@@ -0,0 +1,32 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestCheckUnixBackends(t *testing.T) {
+    defer func(addr string) {
+        defaultStorage.Addr = addr
+    }(defaultStorage.Addr)
+
+    cases := []struct {
+        def  string
+        spec string
+        ok   bool
+    }{
+        {"127.0.0.1:1", "a=/tmp/a.sock,b=/tmp/b.sock", false},
+        {"127.0.0.1:1", "a=/tmp/a.sock,b=127.0.0.1:2", true},
+        {"/tmp/storage.sock", "a=/tmp/a.sock", false},
+        {"/tmp/storage.sock", "a=127.0.0.1:2,b=127.0.0.1:3", true},
+    }
+    for _, c := range cases {
+        defaultStorage.Addr = c.def
+        backends, err := parseStorageBackends(c.spec)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := checkUnixBackends(backends); (err == nil) != c.ok {
+            t.Errorf("default %s, %s: got %v", c.def, c.spec, err)
+        }
+    }
+}
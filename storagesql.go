@@ -0,0 +1,189 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/packing/clove/codecs"
+    "github.com/packing/clove/messages"
+    "github.com/packing/clove/nnet"
+    "github.com/packing/clove/packets"
+)
+
+//storage客户端的DBQuery/DBExec在SQL出错时只把storage返回的错误文本写入日志, 超时与出错都返回空结果.
+//mysql的查询与执行改为经由这里的独立通道发送, 以取得原始回复: 超时由本地等待判定, 字符串回复为SQL错误
+type sqlChannel struct {
+    addr     string
+    bindAddr string
+    timeout  time.Duration
+
+    tcp  *nnet.TCPClient
+    unix *nnet.UnixUDP
+
+    serial  int64
+    waiters sync.Map
+}
+
+//SQL错误, Code取自mysql驱动的"Error 1062: ..."格式, 无法解析时为0
+type StorageSQLError struct {
+    Code    int
+    Message string
+}
+
+func (e *StorageSQLError) Error() string {
+    if e.Code == 0 {
+        return e.Message
+    }
+    return fmt.Sprintf("Error %d: %s", e.Code, e.Message)
+}
+
+var (
+    ErrorStorageUnavailable = errors.New("storage is not available")
+    ErrorStorageTimeout     = errors.New("storage timeout")
+
+    sqlErrorPattern = regexp.MustCompile(`^Error (\d+)(?: \([0-9A-Z]+\))?: (?s)(.*)$`)
+)
+
+func parseSQLError(s string) *StorageSQLError {
+    if m := sqlErrorPattern.FindStringSubmatch(s); m != nil {
+        code, _ := strconv.Atoi(m[1])
+        return &StorageSQLError{Code: code, Message: m[2]}
+    }
+    return &StorageSQLError{Message: s}
+}
+
+//unix模式下每个后端绑定独立的回复地址, 不与storage客户端的/tmp/nbdb_client_<pid>.sock冲突
+func createSQLChannel(name string, addr string, timeout time.Duration, buffer int) (*sqlChannel, error) {
+    c := &sqlChannel{addr: addr, timeout: timeout}
+    if strings.Contains(addr, ":") {
+        c.tcp = nnet.CreateTCPClient(packets.PacketFormatNB, codecs.CodecIMv2)
+        c.tcp.OnDataDecoded = c.onReply
+        if err := c.tcp.Connect(addr, 0); err != nil {
+            return nil, err
+        }
+        return c, nil
+    }
+    c.bindAddr = fmt.Sprintf("/tmp/nbdb_sql_%d_%s.sock", os.Getpid(), name)
+    c.unix = nnet.CreateUnixUDPWithFormatAndBufferSize(packets.PacketFormatNB, codecs.CodecIMv2, buffer, buffer)
+    c.unix.OnDataDecoded = c.onReply
+    os.Remove(c.bindAddr)
+    if err := c.unix.Bind(c.bindAddr); err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+func (c *sqlChannel) close() {
+    if c.tcp != nil {
+        c.tcp.Close()
+    }
+    if c.unix != nil {
+        c.unix.Close()
+        os.Remove(c.bindAddr)
+    }
+}
+
+//等待通道带一个缓冲且从不关闭, 超时后迟到的回复直接丢弃
+func (c *sqlChannel) onReply(_ nnet.Controller, _ string, msg codecs.IMData) error {
+    m, ok := msg.(codecs.IMMap)
+    if !ok {
+        return nil
+    }
+    r := codecs.CreateMapReader(m)
+    w, ok := c.waiters.LoadAndDelete(r.IntValueOf(messages.ProtocolKeySerial, 0))
+    if !ok {
+        return nil
+    }
+    select {
+    case w.(chan interface{}) <- r.TryReadValue(messages.ProtocolKeyBody):
+    default:
+    }
+    return nil
+}
+
+func (c *sqlChannel) request(typ int, sql string, args []interface{}) (interface{}, error) {
+    serial := atomic.AddInt64(&c.serial, 1)
+    ch := make(chan interface{}, 1)
+    c.waiters.Store(serial, ch)
+    defer c.waiters.Delete(serial)
+
+    body := codecs.IMMap{}
+    body[messages.ProtocolKeySQL] = sql
+    body[messages.ProtocolKeyArgs] = args
+    msg := codecs.IMMap{}
+    msg[messages.ProtocolKeyScheme] = messages.ProtocolSchemeS2S
+    msg[messages.ProtocolKeyTag] = codecs.IMSlice{messages.ProtocolTagStorage}
+    msg[messages.ProtocolKeyType] = typ
+    msg[messages.ProtocolKeySerial] = serial
+    msg[messages.ProtocolKeyBody] = body
+
+    if c.unix != nil {
+        msg[messages.ProtocolKeyUnixAddr] = c.bindAddr
+        if _, err := c.unix.SendTo(c.addr, msg); err != nil {
+            return nil, ErrorStorageUnavailable
+        }
+    } else {
+        c.tcp.Send(msg)
+    }
+
+    tr := time.NewTimer(c.timeout)
+    defer tr.Stop()
+    select {
+    case ret := <-ch:
+        if s, ok := ret.(string); ok {
+            return nil, parseSQLError(s)
+        }
+        return ret, nil
+    case <-tr.C:
+        return nil, ErrorStorageTimeout
+    }
+}
+
+func (c *sqlChannel) query(sql string, args []interface{}) ([]interface{}, error) {
+    ret, err := c.request(messages.ProtocolTypeDBQuery, sql, args)
+    if err != nil {
+        return nil, err
+    }
+    switch rows := ret.(type) {
+    case []interface{}:
+        return rows, nil
+    case nil:
+        return []interface{}{}, nil
+    }
+    return nil, &StorageSQLError{Message: fmt.Sprintf("unexpected query reply %T", ret)}
+}
+
+type sqlExecResult struct {
+    affected    int64
+    insertId    int64
+    hasInsertId bool
+}
+
+//exec的回复为影响行数; 支持insertId的storage回复{ProtocolKeyResult: 影响行数, ProtocolKeyId: LastInsertId},
+//LastInsertId取自执行该语句的同一连接. IMv2按数值大小解码为不同的整数类型
+func (c *sqlChannel) exec(sql string, args []interface{}) (sqlExecResult, error) {
+    ret, err := c.request(messages.ProtocolTypeDBExec, sql, args)
+    if err != nil {
+        return sqlExecResult{}, err
+    }
+    switch v := ret.(type) {
+    case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+        return sqlExecResult{affected: codecs.Int64FromInterface(v)}, nil
+    case codecs.IMMap:
+        r := codecs.CreateMapReader(v)
+        id := r.TryReadValue(messages.ProtocolKeyId)
+        return sqlExecResult{
+            affected:    codecs.Int64FromInterface(r.TryReadValue(messages.ProtocolKeyResult)),
+            insertId:    codecs.Int64FromInterface(id),
+            hasInsertId: id != nil,
+        }, nil
+    }
+    return sqlExecResult{}, &StorageSQLError{Message: fmt.Sprintf("unexpected exec reply %T", ret)}
+}
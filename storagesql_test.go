@@ -0,0 +1,111 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "testing"
+    "time"
+
+    "github.com/packing/clove/codecs"
+    "github.com/packing/clove/messages"
+    "github.com/packing/clove/nnet"
+    "github.com/packing/clove/packets"
+    "github.com/packing/goja"
+)
+
+//按SQL内容回复的storage: bad返回mysql错误文本, slow不回复, insert带回insertId; record不为nil时记录收到的语句
+func newFakeSQLStorage(t *testing.T, record func(sql string, args []interface{})) string {
+    addr := fmt.Sprintf("/tmp/nbdb_fake_storage_%d.sock", os.Getpid())
+    srv := nnet.CreateUnixUDPWithFormatAndBufferSize(packets.PacketFormatNB, codecs.CodecIMv2, 65536, 65536)
+    srv.OnDataDecoded = func(_ nnet.Controller, _ string, msg codecs.IMData) error {
+        m := msg.(codecs.IMMap)
+        r := codecs.CreateMapReader(m)
+        body := codecs.CreateMapReader(r.TryReadValue(messages.ProtocolKeyBody).(codecs.IMMap))
+        if record != nil {
+            args, _ := body.TryReadValue(messages.ProtocolKeyArgs).([]interface{})
+            record(body.StrValueOf(messages.ProtocolKeySQL, ""), args)
+        }
+        var reply interface{}
+        switch body.StrValueOf(messages.ProtocolKeySQL, "") {
+        case "slow":
+            return nil
+        case "bad":
+            reply = "Error 1064 (42000): You have an error in your SQL syntax"
+        case "insert":
+            reply = codecs.IMMap{messages.ProtocolKeyResult: int64(1), messages.ProtocolKeyId: int64(42)}
+        case "rows":
+            reply = []interface{}{codecs.IMMap{"id": int64(1)}}
+        default:
+            if r.IntValueOf(messages.ProtocolKeyType, 0) == messages.ProtocolTypeDBQuery {
+                reply = []interface{}{}
+            } else {
+                reply = int64(3)
+            }
+        }
+        srv.SendTo(r.StrValueOf(messages.ProtocolKeyUnixAddr, ""), codecs.IMMap{
+            messages.ProtocolKeySerial: r.IntValueOf(messages.ProtocolKeySerial, 0),
+            messages.ProtocolKeyBody:   reply,
+        })
+        return nil
+    }
+    os.Remove(addr)
+    if err := srv.Bind(addr); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        srv.Close()
+        os.Remove(addr)
+    })
+    return addr
+}
+
+func TestSQLChannel(t *testing.T) {
+    c, err := createSQLChannel("test", newFakeSQLStorage(t, nil), 100*time.Millisecond, 65536)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.close()
+
+    if rows, err := c.query("rows", nil); err != nil || len(rows) != 1 {
+        t.Errorf("query: got %v %v", rows, err)
+    }
+    if res, err := c.exec("update", nil); err != nil || res != (sqlExecResult{affected: 3}) {
+        t.Errorf("exec: got %+v %v", res, err)
+    }
+    if res, err := c.exec("insert", nil); err != nil || res != (sqlExecResult{affected: 1, insertId: 42, hasInsertId: true}) {
+        t.Errorf("exec with insert id: got %+v %v", res, err)
+    }
+    _, err = c.exec("bad", nil)
+    if e, ok := err.(*StorageSQLError); !ok || e.Code != 1064 || e.Message != "You have an error in your SQL syntax" {
+        t.Errorf("sql error: got %#v", err)
+    }
+    if _, err := c.query("slow", nil); err != ErrorStorageTimeout {
+        t.Errorf("timeout: got %v", err)
+    }
+}
+
+func TestParseSQLError(t *testing.T) {
+    for s, want := range map[string]StorageSQLError{
+        "Error 1062: Duplicate entry '1' for key 'PRIMARY'": {1062, "Duplicate entry '1' for key 'PRIMARY'"},
+        "Error 1146 (42S02): Table 'x' doesn't exist":       {1146, "Table 'x' doesn't exist"},
+        "sql: database is closed":                          {0, "sql: database is closed"},
+    } {
+        if got := parseSQLError(s); *got != want {
+            t.Errorf("%s: got %#v", s, got)
+        }
+    }
+}
+
+func TestExecResult(t *testing.T) {
+    vm := &GojaVM{Runtime: goja.New()}
+    n := GojaVMNet{vm: vm}
+    vm.Runtime.Set("withId", n.execResult(sqlExecResult{affected: 1, insertId: 42, hasInsertId: true}))
+    vm.Runtime.Set("withoutId", n.execResult(sqlExecResult{affected: 2}))
+    v, err := vm.Runtime.RunString(`[withId.affectedRows, withId.insertId, withoutId.insertId, withoutId == 2].join(",")`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := v.String(); got != "1,42,,true" {
+        t.Errorf("got %s", got)
+    }
+}
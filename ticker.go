@@ -0,0 +1,262 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/packing/clove/utils"
+    "github.com/packing/goja"
+)
+
+type cronField uint64
+
+type CronSchedule struct {
+    name   string
+    expr   string
+    minute cronField
+    hour   cronField
+    dom    cronField
+    month  cronField
+    dow    cronField
+    //日与周都受限时任一匹配即可, 与标准cron一致
+    domOrDow bool
+    running  int32
+}
+
+var (
+    tickInterval time.Duration = 0
+    tickRunning  int32
+    tickLast     time.Time
+
+    cronLock      sync.Mutex
+    cronSchedules = make(map[string]*CronSchedule)
+
+    tickStopCh chan int
+)
+
+func parseCronField(s string, min, max int) (cronField, error) {
+    var f cronField
+    for _, part := range strings.Split(s, ",") {
+        step := 1
+        if i := strings.Index(part, "/"); i >= 0 {
+            v, err := strconv.Atoi(part[i+1:])
+            if err != nil || v <= 0 {
+                return 0, fmt.Errorf("invalid step %q", part)
+            }
+            step = v
+            part = part[:i]
+        }
+        lo, hi := min, max
+        if part != "*" {
+            if i := strings.Index(part, "-"); i >= 0 {
+                a, err1 := strconv.Atoi(part[:i])
+                b, err2 := strconv.Atoi(part[i+1:])
+                if err1 != nil || err2 != nil {
+                    return 0, fmt.Errorf("invalid range %q", part)
+                }
+                lo, hi = a, b
+            } else {
+                v, err := strconv.Atoi(part)
+                if err != nil {
+                    return 0, fmt.Errorf("invalid value %q", part)
+                }
+                lo = v
+                if step == 1 {
+                    hi = v
+                }
+            }
+        }
+        if lo < min || hi > max || lo > hi {
+            return 0, fmt.Errorf("value out of range %q", part)
+        }
+        for v := lo; v <= hi; v += step {
+            f |= 1 << uint(v)
+        }
+    }
+    return f, nil
+}
+
+//标准5段格式: 分 时 日 月 周
+func parseCronSchedule(name, expr string) (*CronSchedule, error) {
+    fields := strings.Fields(expr)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+    }
+    s := &CronSchedule{name: name, expr: expr}
+    var err error
+    if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+        return nil, err
+    }
+    if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+        return nil, err
+    }
+    if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+        return nil, err
+    }
+    if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+        return nil, err
+    }
+    //周日可写作0或7, 解析后再合并, 以支持5-7这样的范围
+    if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+        return nil, err
+    }
+    if s.dow&(1<<7) != 0 {
+        s.dow = s.dow&^(1<<7) | 1
+    }
+    s.domOrDow = !strings.HasPrefix(fields[2], "*") && !strings.HasPrefix(fields[4], "*")
+    return s, nil
+}
+
+func (s *CronSchedule) match(t time.Time) bool {
+    if s.minute&(1<<uint(t.Minute())) == 0 ||
+        s.hour&(1<<uint(t.Hour())) == 0 ||
+        s.month&(1<<uint(t.Month())) == 0 {
+        return false
+    }
+    dom := s.dom&(1<<uint(t.Day())) != 0
+    dow := s.dow&(1<<uint(t.Weekday())) != 0
+    if s.domOrDow {
+        return dom || dow
+    }
+    return dom && dow
+}
+
+func addCronSchedule(name, expr string) error {
+    s, err := parseCronSchedule(name, expr)
+    if err != nil {
+        return err
+    }
+    cronLock.Lock()
+    defer cronLock.Unlock()
+    cronSchedules[name] = s
+    return nil
+}
+
+func removeCronSchedule(name string) bool {
+    cronLock.Lock()
+    defer cronLock.Unlock()
+    _, ok := cronSchedules[name]
+    delete(cronSchedules, name)
+    return ok
+}
+
+func (n GojaVMNet) CronAdd(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) < 2 {
+        return n.vm.Runtime.ToValue(false)
+    }
+    if !gojaInitializing {
+        stacks := make([]goja.StackFrame, 5)
+        errStr := GenGojaStackFrameString(n.vm, "[J] !!! cron.add can only be called in __init__", n.vm.Runtime.CaptureCallStack(5, stacks))
+        utils.LogError(errStr)
+        return n.vm.Runtime.ToValue(false)
+    }
+    err := addCronSchedule(call.Arguments[0].String(), call.Arguments[1].String())
+    if err != nil {
+        stacks := make([]goja.StackFrame, 5)
+        errStr := GenGojaStackFrameString(n.vm, "[J] !!! "+err.Error(), n.vm.Runtime.CaptureCallStack(5, stacks))
+        utils.LogError(errStr)
+        return n.vm.Runtime.ToValue(false)
+    }
+    return n.vm.Runtime.ToValue(true)
+}
+
+func (n GojaVMNet) CronRemove(call goja.FunctionCall) goja.Value {
+    if len(call.Arguments) == 0 {
+        return n.vm.Runtime.ToValue(false)
+    }
+    return n.vm.Runtime.ToValue(removeCronSchedule(call.Arguments[0].String()))
+}
+
+//上一次tick尚未结束时直接跳过, 保证tick不会并发执行
+func runTick(now time.Time) {
+    if !atomic.CompareAndSwapInt32(&tickRunning, 0, 1) {
+        utils.LogWarn(">>> 上一次__tick__尚未结束, 本次跳过")
+        return
+    }
+    go func() {
+        defer atomic.StoreInt32(&tickRunning, 0)
+        defer func() {
+            utils.LogPanic(recover())
+        }()
+
+        dt := time.Duration(0)
+        if !tickLast.IsZero() {
+            dt = now.Sub(tickLast)
+        }
+        tickLast = now
+
+        vm := borrowGojaVM()
+        if vm == nil {
+            return
+        }
+        defer returnGojaVM(vm)
+        vm.DispatchTick(now, dt)
+    }()
+}
+
+func runCron(now time.Time) {
+    cronLock.Lock()
+    due := make([]*CronSchedule, 0)
+    for _, s := range cronSchedules {
+        if s.match(now) {
+            due = append(due, s)
+        }
+    }
+    cronLock.Unlock()
+
+    for _, s := range due {
+        if !atomic.CompareAndSwapInt32(&s.running, 0, 1) {
+            utils.LogWarn(">>> 定时任务 %s 上一次执行尚未结束, 本次跳过", s.name)
+            continue
+        }
+        go func(s *CronSchedule) {
+            defer atomic.StoreInt32(&s.running, 0)
+            defer func() {
+                utils.LogPanic(recover())
+            }()
+
+            vm := borrowGojaVM()
+            if vm == nil {
+                return
+            }
+            defer returnGojaVM(vm)
+            vm.DispatchCron(s.name, now)
+        }(s)
+    }
+}
+
+func startTicker() {
+    tickStopCh = make(chan int)
+    go func() {
+        var tickCh <-chan time.Time
+        if tickInterval > 0 {
+            t := time.NewTicker(tickInterval)
+            defer t.Stop()
+            tickCh = t.C
+        }
+        cronTimer := time.NewTimer(time.Until(time.Now().Truncate(time.Minute).Add(time.Minute)))
+        defer cronTimer.Stop()
+        for {
+            select {
+            case <-tickStopCh:
+                return
+            case now := <-tickCh:
+                runTick(now)
+            case now := <-cronTimer.C:
+                runCron(now.Truncate(time.Minute))
+                cronTimer.Reset(time.Until(time.Now().Truncate(time.Minute).Add(time.Minute)))
+            }
+        }
+    }()
+}
+
+func stopTicker() {
+    if tickStopCh != nil {
+        close(tickStopCh)
+        tickStopCh = nil
+    }
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestCronSchedule(t *testing.T) {
+    //2024-06-01为周六, 2024-06-02为周日, 2024-06-03为周一
+    day := func(d int) time.Time {
+        return time.Date(2024, 6, d, 12, 0, 0, 0, time.Local)
+    }
+    cases := []struct {
+        expr string
+        t    time.Time
+        want bool
+    }{
+        {"0 12 * * 5-7", day(1), true},
+        {"0 12 * * 5-7", day(2), true},
+        {"0 12 * * 5-7", day(3), false},
+        {"0 12 * * 7", day(2), true},
+        {"0 12 * * 0", day(2), true},
+        {"0 12 * * */2", day(2), true},
+        {"0 12 1 * 1", day(1), true},
+        {"0 12 1 * 1", day(3), true},
+        {"0 12 1 * 1", day(2), false},
+        {"0 12 1 * *", day(3), false},
+        {"0 12 */10 * 1", day(2), false},
+        {"0 12 * * 1", day(1), false},
+        {"30 12 * * *", day(1), false},
+    }
+    for _, c := range cases {
+        s, err := parseCronSchedule("t", c.expr)
+        if err != nil {
+            t.Fatalf("%s: %v", c.expr, err)
+        }
+        if got := s.match(c.t); got != c.want {
+            t.Errorf("%s at %s: got %v, want %v", c.expr, c.t.Format("Mon 2006-01-02"), got, c.want)
+        }
+    }
+
+    for _, expr := range []string{"0 12 * * 8", "0 12 * * 7-5", "0 12 0 * *", "0 12 * *"} {
+        if _, err := parseCronSchedule("t", expr); err == nil {
+            t.Errorf("%s: expected error", expr)
+        }
+    }
+}
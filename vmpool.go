@@ -1,6 +1,8 @@
 package main
 
 import (
+    "time"
+
     "github.com/packing/v8go"
 )
 
@@ -50,6 +52,42 @@ func freeVM(vm v8go.VM) {
     }()
 }
 
+//供非客户端消息(管理指令, 定时任务等)借用脚本上下文
+func borrowGojaVM() *GojaVM {
+    if freeVMQueue == nil {
+        return nil
+    }
+    vm, ok := getVM().(*GojaVM)
+    if !ok {
+        return nil
+    }
+    return vm
+}
+
+//与borrowGojaVM相同, 但最多等待wait, 超时返回nil
+func borrowGojaVMTimeout(wait time.Duration) *GojaVM {
+    queue := freeVMQueue
+    if queue == nil {
+        return nil
+    }
+    timer := time.NewTimer(wait)
+    defer timer.Stop()
+    select {
+    case vm := <-queue:
+        if gvm, ok := vm.(*GojaVM); ok {
+            return gvm
+        }
+        return nil
+    case <-timer.C:
+        return nil
+    }
+}
+
+func returnGojaVM(vm *GojaVM) {
+    vm.SetValue("CurrentSessionId", 0)
+    freeVM(vm)
+}
+
 func getVMFree() int {
     return len(freeVMQueue)
 }